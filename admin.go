@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultListLimit = 100
+const maxListLimit = 1000
+
+type listedLink struct {
+	Slug string `json:"slug"`
+	URL  string `json:"url"`
+}
+
+type listResult struct {
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Links  []listedLink `json:"links"`
+}
+
+// sortedSlugs needs to be called with at least the read lock on storage held
+func sortedSlugs() []string {
+	slugs := make([]string, 0, storage.Len())
+	storage.Each(func(slug, url string) {
+		slugs = append(slugs, slug)
+	})
+	sort.Strings(slugs)
+	return slugs
+}
+
+func intParam(r *http.Request, name string, value int) (int, error) {
+	if s := r.FormValue(name); s != "" {
+		n, e := strconv.Atoi(s)
+		if e != nil || n < 0 {
+			return 0, fmt.Errorf("invalid %s: %q", name, s)
+		}
+		return n, nil
+	}
+	return value, nil
+}
+
+// handleList pages through all shortened URLs, ordered by slug so that paging is stable
+func handleList(w http.ResponseWriter, r *http.Request) {
+	if !validSecret(requestSecret(r, r.FormValue("secret"))) {
+		notAuthorized(w)
+		return
+	}
+	offset, e := intParam(r, "offset", 0)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, e := intParam(r, "limit", defaultListLimit)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	result := listResult{Offset: offset, Limit: limit, Links: []listedLink{}}
+	storageMutex.RLock()
+	slugs := sortedSlugs()
+	result.Total = len(slugs)
+	for ix := offset; ix < len(slugs) && ix < offset+limit; ix++ {
+		url, _ := storage.Get(slugs[ix])
+		result.Links = append(result.Links, listedLink{Slug: slugs[ix], URL: url})
+	}
+	storageMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type staleLink struct {
+	Slug     string     `json:"slug"`
+	URL      string     `json:"url"`
+	Clicks   uint64     `json:"clicks"`
+	Accessed *time.Time `json:"accessed,omitempty"`
+	Created  *time.Time `json:"created,omitempty"`
+}
+
+type staleResult struct {
+	Before time.Time   `json:"before"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Links  []staleLink `json:"links"`
+}
+
+// cutoffParam reads the before parameter, either a time like 2024-01-31T00:00:00Z or a duration like
+// 720h before now
+func cutoffParam(r *http.Request) (time.Time, error) {
+	value := r.FormValue("before")
+	if value == "" {
+		return time.Time{}, errors.New("missing before - give a time like 2024-01-31T00:00:00Z or a duration like 720h")
+	}
+	if cutoff, e := time.Parse(time.RFC3339, value); e == nil {
+		return cutoff, nil
+	}
+	if ago, e := time.ParseDuration(value); e == nil && ago >= 0 {
+		return time.Now().Add(-ago), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid before: %q", value)
+}
+
+// handleStale pages through the slugs that haven't been followed since the cutoff, ordered by slug. A slug
+// that has never been followed counts from when it was created, and one with neither time known is always
+// stale
+func handleStale(w http.ResponseWriter, r *http.Request) {
+	if !validSecret(requestSecret(r, r.FormValue("secret"))) {
+		notAuthorized(w)
+		return
+	}
+	cutoff, e := cutoffParam(r)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, e := intParam(r, "offset", 0)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, e := intParam(r, "limit", defaultListLimit)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	result := staleResult{Before: cutoff, Offset: offset, Limit: limit, Links: []staleLink{}}
+	storageMutex.RLock()
+	clicksMutex.Lock()
+	for _, slug := range sortedSlugs() {
+		link := staleLink{Slug: slug, Clicks: clicks[slug]}
+		last := createdAt[slug]
+		if created, ok := createdAt[slug]; ok {
+			link.Created = &created
+		}
+		if accessed, ok := lastAccess[slug]; ok {
+			link.Accessed = &accessed
+			last = accessed
+		}
+		if !last.Before(cutoff) {
+			continue
+		}
+		if result.Total >= offset && len(result.Links) < limit {
+			link.URL, _ = storage.Get(slug)
+			result.Links = append(result.Links, link)
+		}
+		result.Total++
+	}
+	clicksMutex.Unlock()
+	storageMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type searchResult struct {
+	Total int          `json:"total"`
+	Limit int          `json:"limit"`
+	Links []listedLink `json:"links"`
+}
+
+// handleSearch finds the slugs starting with prefix and containing contains, of which at least one has to
+// be given. Total counts every match, while at most limit of them are returned, ordered by slug
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if !validSecret(requestSecret(r, r.FormValue("secret"))) {
+		notAuthorized(w)
+		return
+	}
+	prefix, contains := normalizeSlug(r.FormValue("prefix")), normalizeSlug(r.FormValue("contains"))
+	if prefix == "" && contains == "" {
+		http.Error(w, "Give a prefix or contains to search for", http.StatusBadRequest)
+		return
+	}
+	limit, e := intParam(r, "limit", defaultListLimit)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	matches := []listedLink{}
+	storageMutex.RLock()
+	storage.Each(func(slug, url string) {
+		if strings.HasPrefix(slug, prefix) && strings.Contains(slug, contains) {
+			matches = append(matches, listedLink{Slug: slug, URL: url})
+		}
+	})
+	storageMutex.RUnlock()
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Slug < matches[j].Slug })
+
+	result := searchResult{Total: len(matches), Limit: limit, Links: matches[:min(limit, len(matches))]}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An alias is an extra slug for a URL that has already been shortened. It redirects like any other slug,
+// but the URL keeps being deduplicated to the slug it had first, even with -dedupe-targets
+
+var errSlugTaken = errors.New("slug is already in use")
+var errInvalidSlug = errors.New("slug contains characters that aren't allowed")
+var errNotShortened = errors.New("URL hasn't been shortened")
+
+// Slugs created as aliases. Protected by storageMutex
+var aliases = make(map[string]bool)
+
+// storeSlug points the slug at the URL. Aliases and restricted links only become the slug for the URL when
+// it has none, so that they don't take deduplication over from a plain link. It needs to be called with
+// the write lock on storage held
+func storeSlug(slug, url string, secondary bool) {
+	if secondary {
+		storage.Alias(slug, url)
+	} else {
+		storage.Put(slug, url)
+	}
+}
+
+// promoteAlias makes one of the aliases of the URL its slug, when the slug it was an alias of has gone
+// away or been pointed elsewhere. It needs to be called with the write lock on storage held
+func promoteAlias(url string) {
+	if _, ok := storage.GetSlugForURL(url); ok || url == "" {
+		return
+	}
+	for alias := range aliases {
+		if target, _ := storage.Get(alias); target == url {
+			storage.Alias(alias, url)
+			return
+		}
+	}
+}
+
+// createAlias adds the slug as an alias of the URL and persists it. Unlike with submissions, the slug has
+// to be given and has to be free, since a generated alias wouldn't be memorable. When persisting fails,
+// the alias is taken back and errNotStored returned
+func createAlias(slug, url string, meta linkMeta) error {
+	slug = normalizeSlug(slug)
+	if reservedSlugs[slug] {
+		return errReservedSlug
+	}
+	if len(slug) < *MinSlugLengthConfig || len(slug) > *MaxSlugLengthConfig {
+		return errSlugLength
+	}
+	if invalidSlug(slug) {
+		return errInvalidSlug
+	}
+	if e := addAlias(slug, url, meta); e != nil {
+		return e
+	}
+	if e := awaitStored(slug); e != nil {
+		return e
+	}
+	slugsCreatedTotal.Add(1)
+	return nil
+}
+
+// addAlias is the part of createAlias done with the write lock on storage held
+func addAlias(slug, url string, meta linkMeta) error {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	if _, exists := storage.Get(slug); exists {
+		return errSlugTaken
+	}
+	if caseVariantTaken(slug) {
+		return errCaseVariant
+	}
+	if _, ok := storage.GetSlugForURL(url); !ok {
+		return errNotShortened
+	}
+	if storageFull() {
+		return errStorageFull
+	}
+	if overQuota(meta.creator) {
+		return errQuotaExceeded
+	}
+	meta.alias = true
+	storage.Alias(slug, url)
+	setMeta(slug, meta)
+	if e := persistSlugs(slug); e != nil {
+		removeSlug(slug)
+		return errNotStored
+	}
+	return nil
+}
+
+func handleAlias(w http.ResponseWriter, r *http.Request) {
+	creator, authorized := authenticate(requestSecret(r, r.PostFormValue("secret")))
+	if !authorized {
+		notAuthorized(w)
+		return
+	}
+	slug := r.PostFormValue("slug")
+	url := normalizeTarget(strings.TrimSpace(r.PostFormValue("url")))
+
+	e := createAlias(slug, url, linkMeta{creator: creator, created: time.Now(), ip: clientIP(r)})
+	switch e {
+	case nil:
+		slog.Info("added alias", "slug", normalizeSlug(slug), targetAttr("target", url), "client", clientIP(r))
+		writeShortened(w, r, submitResult{Slug: normalizeSlug(slug), Target: url})
+	case errNotShortened:
+		http.Error(w, "The URL has to be shortened before it can get an alias", http.StatusNotFound)
+	default:
+		failSubmit(w, e, slug)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type bulkItem struct {
+	URL  string `json:"url"`
+	Slug string `json:"slug,omitempty"`
+}
+
+type bulkResult struct {
+	URL      string `json:"url"`
+	Slug     string `json:"slug,omitempty"`
+	ShortURL string `json:"short_url,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// takeBack removes the slugs that couldn't be persisted, failing their items. It needs to be called with
+// the write lock on storage held
+func takeBack(slugs []string, results []bulkResult) {
+	for _, slug := range slugs {
+		removeSlug(slug)
+	}
+	failStored(slugs, results)
+}
+
+// failStored fails the items that were given slugs which couldn't be persisted
+func failStored(slugs []string, results []bulkResult) {
+	failed := make(map[string]bool, len(slugs))
+	for _, slug := range slugs {
+		failed[slug] = true
+	}
+	for ix := range results {
+		if failed[results[ix].Slug] {
+			_, kind := submitStatus(errNotStored)
+			countSubmitError(kind)
+			results[ix] = bulkResult{URL: results[ix].URL, Error: submitMessage(errNotStored, results[ix].Slug)}
+		}
+	}
+}
+
+// handleBulk shortens a JSON array of URLs in one request. Every item gets its own result, so that
+// one bad URL doesn't fail the whole batch, and all new slugs are persisted with a single write
+func handleBulk(w http.ResponseWriter, r *http.Request) {
+	// The body is JSON, so the secret has to come in the query string or with Basic auth
+	creator, authorized := authenticate(requestSecret(r, r.URL.Query().Get("secret")))
+	if !authorized {
+		countSubmitError(submitErrorUnauthorized)
+		notAuthorized(w)
+		return
+	}
+	if !allowSubmitFrom(r, creator) {
+		countSubmitError(submitErrorRateLimited)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var items []bulkItem
+	if e := json.NewDecoder(r.Body).Decode(&items); bodyTooLarge(w, e) {
+		return
+	} else if e != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", e), http.StatusBadRequest)
+		return
+	}
+
+	// Validation can involve DNS lookups, so it's done before taking the lock
+	results := make([]bulkResult, len(items))
+	meta := linkMeta{creator: creator, created: time.Now(), ip: clientIP(r)}
+	for ix, item := range items {
+		item.URL = normalizeTarget(strings.TrimSpace(item.URL))
+		items[ix].URL = item.URL
+		results[ix].URL = item.URL
+		if e := validateTarget(item.URL); e != nil {
+			countSubmitError(submitErrorInvalidURL)
+			results[ix].Error = e.Error()
+		} else if e := validateLine(item.Slug, item.URL, meta); e != nil {
+			countSubmitError(submitErrorInvalidURL)
+			results[ix].Error = e.Error()
+		}
+	}
+
+	var created []string
+	storageMutex.Lock()
+	for ix, item := range items {
+		if results[ix].Error != "" {
+			continue
+		}
+		slug, isNew, e := shorten(item.URL, item.Slug, meta)
+		if e != nil {
+			_, kind := submitStatus(e)
+			countSubmitError(kind)
+			results[ix].Error = submitMessage(e, item.Slug)
+			continue
+		}
+		if isNew {
+			created = append(created, slug)
+			slog.Info("added new shortening", "slug", slug, targetAttr("target", item.URL), "client", clientIP(r))
+		}
+		results[ix].Slug = slug
+		results[ix].ShortURL = fmt.Sprintf("%s/%s", serverName(r), slug)
+	}
+	// Links that would be lost on restart are taken back, like with single submissions
+	if len(created) > 0 {
+		if e := persistSlugs(created...); e != nil {
+			takeBack(created, results)
+			created = nil
+		}
+	}
+	storageMutex.Unlock()
+	if e := awaitStored(created...); e != nil {
+		failStored(created, results)
+	} else {
+		slugsCreatedTotal.Add(uint64(len(created)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// With -slug-checksum, the last character of generated slugs is a Luhn mod N check character over the
+// rest, using the slug alphabet. It catches any single mistyped character and most swapped neighbours,
+// so a lookup that fails the check can be answered with what was probably meant instead of a plain 404
+
+const maxSuggestions = 3
+
+// luhnSum adds up the characters in the Luhn way, doubling every other one counting from the right. It
+// returns false if a character isn't in the alphabet
+func luhnSum(slug string, alphabet []rune, double bool) (int, bool) {
+	base := len(alphabet)
+	runes := []rune(slug)
+	sum := 0
+	for ix := len(runes) - 1; ix >= 0; ix-- {
+		value := slices.Index(alphabet, runes[ix])
+		if value < 0 {
+			return 0, false
+		}
+		if double {
+			value *= 2
+		}
+		double = !double
+		sum += value/base + value%base
+	}
+	return sum, true
+}
+
+// withChecksum appends the check character to a generated slug
+func withChecksum(slug string) string {
+	alphabet := []rune(slugPossibilities())
+	sum, _ := luhnSum(slug, alphabet, true)
+	return slug + string(alphabet[(len(alphabet)-sum%len(alphabet))%len(alphabet)])
+}
+
+func validChecksum(slug string) bool {
+	alphabet := []rune(slugPossibilities())
+	sum, ok := luhnSum(slug, alphabet, false)
+	return ok && sum%len(alphabet) == 0
+}
+
+// suggestSlugs finds existing slugs that the mistyped one could have been meant as, one changed or two
+// swapped characters away. It needs to be called with at least the read lock on storage held
+func suggestSlugs(slug string) []string {
+	var suggestions []string
+	consider := func(candidate []rune) {
+		s := string(candidate)
+		if _, ok := storage.Get(s); ok && validChecksum(s) && !slices.Contains(suggestions, s) && len(suggestions) < maxSuggestions {
+			suggestions = append(suggestions, s)
+		}
+	}
+	runes := []rune(slug)
+	for ix := range runes {
+		for _, char := range slugPossibilities() {
+			if char != runes[ix] {
+				candidate := slices.Clone(runes)
+				candidate[ix] = char
+				consider(candidate)
+			}
+		}
+		if ix+1 < len(runes) && runes[ix] != runes[ix+1] {
+			candidate := slices.Clone(runes)
+			candidate[ix], candidate[ix+1] = candidate[ix+1], candidate[ix]
+			consider(candidate)
+		}
+	}
+	return suggestions
+}
+
+// generatedLength is true for lengths that generated slugs can have. Random slugs are at least -space
+// long and grow when the space fills up, sequential ones grow from a single character. It needs to be
+// called with at least the read lock on storage held
+func generatedLength(length int) bool {
+	if *SlugStrategyConfig == slugStrategySequential {
+		return length >= 2 && length <= len(withChecksum(encodeSequence(nextSequence)))
+	}
+	shortest := max(*SpaceConfig, *MinSlugLengthConfig)
+	return length >= shortest && length <= max(slugLength, shortest)
+}
+
+// mistypedSlug answers 404 with suggestions when the missing slug fails the checksum and is close to
+// existing slugs. It returns false for everything else, which is most paths that were never generated
+// slugs, so that those get the configured not found answer
+func mistypedSlug(w http.ResponseWriter, r *http.Request) bool {
+	if !*SlugChecksumConfig {
+		return false
+	}
+	slug := normalizeSlug(strings.TrimPrefix(r.URL.Path, "/"))
+	if reservedSlugs[slug] || invalidSlug(slug) || validChecksum(slug) {
+		return false
+	}
+
+	storageMutex.RLock()
+	var suggestions []string
+	if generatedLength(len([]rune(slug))) {
+		suggestions = suggestSlugs(slug)
+	}
+	storageMutex.RUnlock()
+	if len(suggestions) == 0 {
+		return false
+	}
+
+	message := fmt.Sprintf("Not found - %s looks mistyped\nDid you mean", slug)
+	for ix, suggestion := range suggestions {
+		if ix > 0 {
+			message += " or"
+		}
+		message += fmt.Sprintf(" %s/%s", serverName(r), suggestion)
+	}
+	http.Error(w, message+"?", http.StatusNotFound)
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Subcommands work on the configured storage without starting the server, as in
+// goshort import [flags] links.csv or goshort export [flags] links.json
+const (
+	commandImport = "import"
+	commandExport = "export"
+)
+
+// parseCommandLine parses the flags, returning the subcommand if one was given before them
+func parseCommandLine() string {
+	if len(os.Args) > 1 && (os.Args[1] == commandImport || os.Args[1] == commandExport) {
+		flag.CommandLine.Parse(os.Args[2:])
+		return os.Args[1]
+	}
+	flag.Parse()
+	return ""
+}
+
+// fileFormat picks the export format from the extension of the file
+func fileFormat(name string) (string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return exportFormatCSV, nil
+	case ".json":
+		return exportFormatJSON, nil
+	}
+	return "", fmt.Errorf("can't tell the format of %s - the name has to end in .csv or .json", name)
+}
+
+// runCommand runs the subcommand on the file given after the flags. The storage has to be open already
+func runCommand(command string) error {
+	if flag.NArg() != 1 {
+		return errors.New("expected exactly one file name after the flags")
+	}
+	name := flag.Arg(0)
+	format, e := fileFormat(name)
+	if e != nil {
+		return e
+	}
+
+	if command == commandExport {
+		storageMutex.RLock()
+		links := snapshotLinks()
+		storageMutex.RUnlock()
+		return exportFile(name, format, links)
+	}
+
+	f, e := os.Open(name)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	links, e := readImport(f, format)
+	if e != nil {
+		return fmt.Errorf("invalid import: %v", e)
+	}
+	result, e := importLinks(links, linkMeta{created: time.Now()})
+	if e != nil {
+		return e
+	}
+
+	// Changes are normally written by the flush after a request, or periodically, neither of which happens here
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	if e := activeBackend.flush(); e != nil {
+		return e
+	}
+	slog.Info("imported links", "file", name, "imported", result.Imported, "skipped", result.Skipped)
+	return nil
+}
+
+func exportFile(name, format string, links []listedLink) error {
+	f, e := os.Create(name)
+	if e != nil {
+		return e
+	}
+	if e := writeExport(f, format, links); e != nil {
+		f.Close()
+		return e
+	}
+	if e := f.Close(); e != nil {
+		return e
+	}
+	slog.Info("exported links", "file", name, "links", len(links))
+	return nil
+}
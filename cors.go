@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiPath reports whether the path is one of the API endpoints that browsers on other origins may call.
+// Slug paths are deliberately left out, so redirects never carry CORS headers
+func apiPath(path string) bool {
+	switch path {
+	case "/submit", "/bulk", "/import", "/alias", "/update", "/delete", "/auth-check", "/export", "/stats":
+		return true
+	}
+	return strings.HasPrefix(path, "/stats/") || strings.HasPrefix(path, "/resolve/") || strings.HasPrefix(path, "/admin/")
+}
+
+// allowedOrigin gives the value for Access-Control-Allow-Origin, or an empty string if the origin
+// isn't allowed
+func allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range strings.Split(*CORSOriginsConfig, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// setCORSHeaders adds the CORS headers for the request, and for preflight requests also answers them.
+// It returns true when the request has been handled completely
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	if *CORSOriginsConfig == "" {
+		return false
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	origin := allowedOrigin(r.Header.Get("Origin"))
+	if origin != "" {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	allow := "GET, POST, OPTIONS"
+	if methods, ok := endpointMethods(r.URL.Path); ok {
+		allow = allowHeader(methods)
+	}
+	header.Set("Allow", allow)
+	if origin != "" {
+		header.Set("Access-Control-Allow-Methods", allow)
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			header.Set("Access-Control-Allow-Headers", requested)
+		}
+		header.Set("Access-Control-Max-Age", "600")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	exportFormatCSV  = "csv"
+	exportFormatJSON = "json"
+)
+
+type importResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// snapshotLinks needs to be called with at least the read lock on storage held. Only the
+// references to the strings are copied, so this is cheap compared to buffering a whole export
+func snapshotLinks() []listedLink {
+	slugs := sortedSlugs()
+	links := make([]listedLink, len(slugs))
+	for ix, slug := range slugs {
+		url, _ := storage.Get(slug)
+		links[ix] = listedLink{Slug: slug, URL: url}
+	}
+	return links
+}
+
+// writeExport streams the links in the given format, one record at a time
+func writeExport(w io.Writer, format string, links []listedLink) error {
+	switch format {
+	case exportFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"slug", "url"})
+		for _, link := range links {
+			cw.Write([]string{link.Slug, link.URL})
+		}
+		cw.Flush()
+		return cw.Error()
+	case exportFormatJSON:
+		io.WriteString(w, "[")
+		for ix, link := range links {
+			if ix > 0 {
+				io.WriteString(w, ",")
+			}
+			data, _ := json.Marshal(link)
+			if _, e := fmt.Fprintf(w, "\n%s", data); e != nil {
+				return e
+			}
+		}
+		_, e := io.WriteString(w, "\n]\n")
+		return e
+	}
+	return fmt.Errorf("unknown format: %q - must be either %s or %s", format, exportFormatCSV, exportFormatJSON)
+}
+
+// readImport reads links in the same formats as writeExport produces
+func readImport(r io.Reader, format string) ([]listedLink, error) {
+	var links []listedLink
+	switch format {
+	case exportFormatCSV:
+		records, e := csv.NewReader(r).ReadAll()
+		if e != nil {
+			return nil, e
+		}
+		for ix, record := range records {
+			if len(record) < 2 || (ix == 0 && record[0] == "slug" && record[1] == "url") {
+				continue
+			}
+			links = append(links, listedLink{Slug: record[0], URL: record[1]})
+		}
+	case exportFormatJSON:
+		if e := json.NewDecoder(r).Decode(&links); e != nil {
+			return nil, e
+		}
+	default:
+		return nil, fmt.Errorf("unknown format: %q - must be either %s or %s", format, exportFormatCSV, exportFormatJSON)
+	}
+	return links, nil
+}
+
+// importLinks adds links with their given slugs. Links with invalid or reserved slugs, invalid URLs,
+// lines too long to store, or slugs that already exist are skipped. New slugs are persisted with a single
+// write, and when that fails none of them are kept
+func importLinks(links []listedLink, meta linkMeta) (importResult, error) {
+	var result importResult
+	valid := make([]listedLink, 0, len(links))
+	for _, link := range links {
+		link.Slug = normalizeSlug(link.Slug)
+		length := len(link.Slug)
+		if length < *MinSlugLengthConfig || length > *MaxSlugLengthConfig || invalidSlug(link.Slug) || reservedSlugs[link.Slug] ||
+			validateTarget(link.URL) != nil || validateLine(link.Slug, link.URL, meta) != nil {
+			result.Skipped++
+			continue
+		}
+		valid = append(valid, link)
+	}
+
+	var created []string
+	storageMutex.Lock()
+	for _, link := range valid {
+		if _, exists := storage.Get(link.Slug); exists || storageFull() || overQuota(meta.creator) {
+			result.Skipped++
+			continue
+		}
+		storage.Put(link.Slug, link.URL)
+		setMeta(link.Slug, meta)
+		created = append(created, link.Slug)
+	}
+	if len(created) > 0 {
+		if e := persistSlugs(created...); e != nil {
+			for _, slug := range created {
+				removeSlug(slug)
+			}
+			storageMutex.Unlock()
+			return result, e
+		}
+	}
+	storageMutex.Unlock()
+	if e := awaitStored(created...); e != nil {
+		return result, e
+	}
+	result.Imported = len(created)
+	return result, nil
+}
+
+func exportFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	return exportFormatJSON
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if !validSecret(requestSecret(r, r.FormValue("secret"))) {
+		notAuthorized(w)
+		return
+	}
+	format := exportFormat(r)
+	if format != exportFormatCSV && format != exportFormatJSON {
+		http.Error(w, fmt.Sprintf("unknown format: %q", format), http.StatusBadRequest)
+		return
+	}
+
+	storageMutex.RLock()
+	links := snapshotLinks()
+	storageMutex.RUnlock()
+
+	if format == exportFormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=goshort.%s", format))
+	writeExport(w, format, links)
+}
+
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	// The body is the data to import, so the secret has to come in the query string or with Basic auth
+	creator, authorized := authenticate(requestSecret(r, r.URL.Query().Get("secret")))
+	if !authorized {
+		notAuthorized(w)
+		return
+	}
+	links, e := readImport(r.Body, exportFormat(r))
+	if bodyTooLarge(w, e) {
+		return
+	} else if e != nil {
+		http.Error(w, fmt.Sprintf("invalid import: %v", e), http.StatusBadRequest)
+		return
+	}
+
+	result, e := importLinks(links, linkMeta{creator: creator, created: time.Now(), ip: clientIP(r)})
+	if e != nil {
+		http.Error(w, "Could not store the imported links", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
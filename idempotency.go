@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Submissions carrying an Idempotency-Key header are remembered for -idempotency-window, so that a client
+// retrying a request gets the slug from the first attempt instead of creating another one
+
+const maxIdempotencyKeyLength = 255
+
+type idempotentSubmit struct {
+	url     string
+	slug    string
+	expires time.Time
+}
+
+// Keyed by the identity of the API key and the header value, so different clients can't see each
+// other's submissions. Protected by storageMutex
+var idempotencyKeys = make(map[string]idempotentSubmit)
+
+// idempotencyKey gives the key the submission is remembered under, or an empty string if it isn't
+func idempotencyKey(r *http.Request, creator string) string {
+	header := r.Header.Get("Idempotency-Key")
+	if header == "" || *IdempotencyWindowConfig <= 0 {
+		return ""
+	}
+	return creator + " " + header
+}
+
+// previousSubmit needs to be called with at least the read lock on storage held
+func previousSubmit(key string, now time.Time) (idempotentSubmit, bool) {
+	previous, ok := idempotencyKeys[key]
+	if !ok || key == "" || now.After(previous.expires) {
+		return idempotentSubmit{}, false
+	}
+	return previous, true
+}
+
+// rememberSubmit needs to be called with the write lock on storage held
+func rememberSubmit(key, url, slug string, now time.Time) {
+	if key != "" {
+		idempotencyKeys[key] = idempotentSubmit{url: url, slug: slug, expires: now.Add(*IdempotencyWindowConfig)}
+	}
+}
+
+// forgetSubmit lets the key be used again after the slug it was used for had to be taken back
+func forgetSubmit(key, slug string) {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	if idempotencyKeys[key].slug == slug {
+		delete(idempotencyKeys, key)
+	}
+}
+
+func pruneIdempotencyKeys(now time.Time) {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	for key, previous := range idempotencyKeys {
+		if now.After(previous.expires) {
+			delete(idempotencyKeys, key)
+		}
+	}
+}
+
+func pruneIdempotencyKeysPeriodically(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		pruneIdempotencyKeys(now)
+	}
+}
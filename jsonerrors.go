@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// jsonError is the body of error responses from the API endpoints to clients asking for JSON
+type jsonError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// errorRewriter holds back the plain text bodies written by http.Error, so that finish can send them as
+// JSON instead. Error responses of any other type, like JSON written by a handler itself, pass through
+type errorRewriter struct {
+	http.ResponseWriter
+	status  int
+	message bytes.Buffer
+}
+
+func (e *errorRewriter) WriteHeader(status int) {
+	if e.status != 0 {
+		return
+	}
+	if status >= 400 && strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain") {
+		e.status = status
+		return
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *errorRewriter) Write(data []byte) (int, error) {
+	if e.status != 0 {
+		return e.message.Write(data)
+	}
+	return e.ResponseWriter.Write(data)
+}
+
+func (e *errorRewriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+func (e *errorRewriter) finish() {
+	if e.status == 0 {
+		return
+	}
+	e.Header().Set("Content-Type", "application/json")
+	e.ResponseWriter.WriteHeader(e.status)
+	json.NewEncoder(e.ResponseWriter).Encode(jsonError{Error: strings.TrimSpace(e.message.String()), Code: e.status})
+}
+
+// jsonErrors answers errors from the API endpoints as JSON when the client asks for it, in the same way
+// as successful responses
+func jsonErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiPath(r.URL.Path) || !wantsJSON(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rewriter := &errorRewriter{ResponseWriter: w}
+		next.ServeHTTP(rewriter, r)
+		rewriter.finish()
+	})
+}
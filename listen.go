@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listen opens a TCP listener for each of the hosts in -host, unless -port is empty, and one for
+// -unix-socket if it is given
+func listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	if *ListenPortConfig != "" {
+		for _, host := range strings.Split(*ListenHostConfig, ",") {
+			address := net.JoinHostPort(strings.TrimSpace(host), *ListenPortConfig)
+			l, e := net.Listen("tcp", address)
+			if e != nil {
+				closeAll()
+				return nil, e
+			}
+			listeners = append(listeners, l)
+		}
+	}
+
+	if *UnixSocketConfig != "" {
+		if e := removeStaleSocket(*UnixSocketConfig); e != nil {
+			closeAll()
+			return nil, e
+		}
+		// The listener removes the socket file again when it is closed at shutdown
+		l, e := net.Listen("unix", *UnixSocketConfig)
+		if e != nil {
+			closeAll()
+			return nil, e
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("nothing to listen on - give -port, -unix-socket or both")
+	}
+	return listeners, nil
+}
+
+// removeStaleSocket removes a socket file left behind by a process that didn't shut down cleanly. Anything
+// that isn't a socket is left alone
+func removeStaleSocket(name string) error {
+	info, e := os.Lstat(name)
+	if os.IsNotExist(e) {
+		return nil
+	} else if e != nil {
+		return e
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", name)
+	}
+	if conn, e := net.Dial("unix", name); e == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", name)
+	}
+	return os.Remove(name)
+}
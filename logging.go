@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogging installs the logger configured by -log-level and -log-format as the default
+func setupLogging() error {
+	var level slog.Level
+	if e := level.UnmarshalText([]byte(*LogLevelConfig)); e != nil {
+		return fmt.Errorf("invalid log level: %s - must be one of debug, info, warn or error", *LogLevelConfig)
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(*LogFormatConfig) {
+	case logFormatText:
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, options)))
+	case logFormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, options)))
+	default:
+		return fmt.Errorf("invalid log format: %s - must be either %s or %s", *LogFormatConfig, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// fatal logs the error and exits. It's used for problems at startup that make it impossible to run
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// statusRecorder remembers the status and size of a response for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, e := s.ResponseWriter.Write(data)
+	s.size += n
+	return n, e
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// targetAttr logs a target URL under the key, or nothing at all with -log-targets=false, since targets can
+// carry tokens and personal data in their query strings
+func targetAttr(key, target string) slog.Attr {
+	if !*LogTargetsConfig {
+		return slog.Attr{}
+	}
+	return slog.String(key, target)
+}
+
+// loggedURI gives the request URI with credentials in the query string blanked out. Form values in
+// the body are never looked at, so the secret posted to /submit can't end up in the log. Without
+// -log-targets every query value is blanked out, as is the rest of the path after a wildcard slug,
+// since both can end up in a target. The URL is the one requested, so -base-path is still on the path
+func loggedURI(u *url.URL) string {
+	path := u.Path
+	if stripped, ok := strings.CutPrefix(path, *BasePathConfig); !*LogTargetsConfig && ok && !apiPath(stripped) {
+		if slug, rest, found := strings.Cut(strings.TrimPrefix(stripped, "/"), "/"); found && rest != "" {
+			path = *BasePathConfig + "/" + slug + "/REDACTED"
+		}
+	}
+	if u.RawQuery == "" {
+		return path
+	}
+	query := u.Query()
+	for name := range query {
+		if !*LogTargetsConfig || name == "secret" || name == "password" {
+			query.Set(name, "REDACTED")
+		}
+	}
+	return path + "?" + query.Encode()
+}
+
+// accessLog logs one line for each request handled, when -access-log is given
+func accessLog(next http.Handler) http.Handler {
+	if !*AccessLogConfig {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		slog.Info("access", "method", r.Method, "path", loggedURI(r.URL), "status", recorder.status,
+			"size", recorder.size, "client", clientIP(r), "duration", time.Since(start))
+	})
+}
@@ -2,63 +2,611 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
-	"math/rand"
+	"log/slog"
+	"maps"
+	"math"
+	"math/big"
+	mrand "math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
 )
 
 var (
-	ServerNameConfig      = flag.String("server-name", "http://localhost", "The public name of the URL shortener service, including protocol, and optionally port")
-	SecretConfig          = flag.String("secret", "changeme", "The secret that has to be submitted to be able to create a new shortened URL")
-	SpaceConfig           = flag.Int("space", 5, "The number of characters for links created, using a-zA-Z0-9. The default allows for roughly 900,000,000 links")
-	ListenHostConfig      = flag.String("host", "localhost", "The host to listen for connections")
-	ListenPortConfig      = flag.String("port", "9997", "The port to listen for connections")
-	FilenameStorageConfig = flag.String("storage-file", ".goshort.urls.config", "The file in where to store all shortened URLs so far. This will only be read at startup, but written every time a new URL is created")
+	ServerNameConfig             = flag.String("server-name", "http://localhost", "The public name of the URL shortener service, including protocol, and optionally port")
+	TrustForwardedConfig         = flag.Bool("trust-forwarded-headers", false, "Build short URLs from the X-Forwarded-Proto and X-Forwarded-Host headers set by a reverse proxy, falling back to -server-name")
+	SecretConfig                 = flag.String("secret", "changeme", "The secret that has to be submitted to be able to create a new shortened URL")
+	SpaceConfig                  = flag.Int("space", 5, "The number of characters for links created, using a-zA-Z0-9. The default allows for roughly 900,000,000 links")
+	SlugAlphabetConfig           = flag.String("slug-alphabet", "", "The characters generated slugs are made of, replacing a-zA-Z0-9, for example to leave out look-alikes such as 0, O, 1, l and I. Only letters, digits and -._~ are allowed")
+	CaseInsensitiveConfig        = flag.Bool("case-insensitive", false, "Treat slugs as lower case on creation and lookup, lower casing stored slugs when they are loaded. Generated slugs then only use a-z0-9, so the default -space allows for roughly 60,000,000 links")
+	DedupeTargetsConfig          = flag.Bool("dedupe-targets", true, "Return the existing slug when a URL that has already been shortened is submitted again. When false, a new slug is created every time")
+	ReservedSlugsConfig          = flag.String("reserved-slugs", "", "Comma separated list of slugs that can't be generated or requested, in addition to the paths of all endpoints")
+	SlugBlocklistConfig          = flag.String("slug-blocklist", "", "A file with one word per line. Generated slugs containing any of these words, ignoring case, are thrown away")
+	SlugRandomConfig             = flag.String("slug-random-source", slugRandomCrypto, "Where randomness for generated slugs comes from. 'crypto' makes slugs unguessable, 'math' is faster but predictable")
+	MinSlugLengthConfig          = flag.Int("min-slug-length", 1, "The minimum length of slugs, both requested and generated")
+	MaxSlugLengthConfig          = flag.Int("max-slug-length", 64, "The maximum length of slugs, both requested and generated. Generated slugs never grow beyond this")
+	SlugAttemptsConfig           = flag.Int("slug-attempts", 1000, "How many random slugs are tried at the current length before the length is grown by one character")
+	SlugGrowthConfig             = flag.Int("max-slug-growth", 3, "How many characters generated slugs may grow beyond -space when the keyspace fills up")
+	ListenHostConfig             = flag.String("host", "localhost", "The host to listen for connections. Several hosts can be given, separated by commas")
+	ListenPortConfig             = flag.String("port", "9997", "The port to listen for connections. When empty, only -unix-socket is listened on")
+	FilenameStorageConfig        = flag.String("storage-file", ".goshort.urls.config", "The file in where to store all shortened URLs so far. This will only be read at startup. Changes are written to it as -flush-interval and -storage-mode say. A name ending in .gz makes the file gzip compressed")
+	StorageBackendConfig         = flag.String("storage-backend", storageBackendFile, "Where shortened URLs are persisted. Either 'file' or 'sqlite'")
+	StorageDSNConfig             = flag.String("storage-dsn", "goshort.db", "The data source name used to open the sqlite database. Existing URLs in the storage file are migrated into it the first time it is opened")
+	StorageModeConfig            = flag.String("storage-mode", storageModeRewrite, "How new URLs are written to the storage file. 'rewrite' writes the whole file every time, 'append' only appends the new line")
+	RedirectStatusConfig         = flag.Int("redirect-status", http.StatusMovedPermanently, "The HTTP status used when redirecting a shortened URL. Either 301 (permanent) or 302 (temporary, not cached by browsers)")
+	AllowedSchemesConfig         = flag.String("allowed-schemes", "http,https", "Comma separated list of URL schemes that are accepted for shortened URLs")
+	BlockPrivateConfig           = flag.Bool("block-private-targets", false, "Reject URLs pointing at private, loopback or link-local addresses, including host names resolving to them")
+	SweepIntervalConfig          = flag.Duration("expiry-sweep-interval", time.Minute, "How often expired URLs are removed from storage. Zero disables the sweep, leaving expired URLs to be removed when accessed")
+	FlushIntervalConfig          = flag.Duration("flush-interval", time.Second, "Changes to storage are written at most once per this interval. Zero writes every change immediately")
+	HealthPathConfig             = flag.String("health-path", "/healthz", "The path answering liveness checks")
+	ReadyPathConfig              = flag.String("ready-path", "/readyz", "The path answering readiness checks. Returns 503 until the storage has been loaded")
+	NotFoundPageConfig           = flag.String("notfound-page", "", "An HTML file served when a shortened URL can't be found. If empty or missing, a plain text message is used")
+	MetricsPathConfig            = flag.String("metrics-path", "/metrics", "The path serving Prometheus metrics")
+	LogLevelConfig               = flag.String("log-level", "info", "The minimum level of log messages. One of debug, info, warn or error")
+	LogFormatConfig              = flag.String("log-format", logFormatText, "The format of log messages. Either 'text' for humans or 'json' for log pipelines")
+	ShutdownTimeoutConfig        = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for active requests to finish when shutting down")
+	SubmitRateConfig             = flag.Float64("submit-rate", 0, "How many submissions per second each client may make on average. Zero disables rate limiting")
+	SubmitBurstConfig            = flag.Int("submit-burst", 10, "How many submissions a client may make in a burst before being rate limited")
+	TrustedProxyConfig           = flag.String("trusted-proxy", "", "Comma separated list of addresses or CIDR ranges of reverse proxies whose X-Forwarded-For headers are trusted")
+	KeysFileConfig               = flag.String("keys-file", "", "A file with one API key per line. If given, any of these keys can be used instead of the secret")
+	CompactIntervalConfig        = flag.Duration("compact-interval", time.Hour, "How often the storage file is compacted when running in append mode. Zero disables periodic compaction")
+	PreviewConfig                = flag.Bool("preview", false, "Show a page with the destination and a continue link instead of redirecting right away. Adding raw=1 to the query skips the page")
+	CORSOriginsConfig            = flag.String("cors-origins", "", "Comma separated list of origins allowed to call the API endpoints from a browser, or * for any origin. Empty disables CORS")
+	NormalizeURLsConfig          = flag.Bool("normalize-urls", false, "Normalize submitted URLs before storing them, so that different spellings of the same destination share a slug. This lowercases the scheme and host and removes default ports")
+	StripSlashConfig             = flag.Bool("strip-trailing-slash", false, "Also remove trailing slashes from the path when normalizing URLs")
+	SortQueryConfig              = flag.Bool("sort-query", false, "Also sort the query parameters by name when normalizing URLs")
+	UtilizationWarningConfig     = flag.Float64("utilization-warning", 0.7, "Log a warning when this share of the possible generated slugs is in use")
+	SeedFileConfig               = flag.String("seed-file", "", "A storage file that is loaded at startup but never written to, for example a read-only base configuration. Slugs in the writable storage take precedence, and deleting a seeded slug only lasts until the next restart")
+	MaxStorageLineConfig         = flag.Int("max-storage-line", 1<<20, "The longest line in bytes that is read from the storage file. Longer lines are skipped, so submitted links that wouldn't fit are refused")
+	IdempotencyWindowConfig      = flag.Duration("idempotency-window", 24*time.Hour, "How long a submission with an Idempotency-Key header is remembered, so that retries get the same slug. Zero disables idempotency keys")
+	TLSCertConfig                = flag.String("tls-cert", "", "PEM file with the TLS certificate chain. When given together with -tls-key, connections are served over HTTPS")
+	TLSKeyConfig                 = flag.String("tls-key", "", "PEM file with the private key for -tls-cert")
+	RootRedirectConfig           = flag.String("root-redirect", "", "A URL that requests for / are redirected to, such as a homepage. When empty, / gives a 404")
+	PassthroughQueryConfig       = flag.Bool("passthrough-query", false, "Add the query string of a request for a short URL to the target when redirecting. Parameters the target already has are replaced by the ones in the request")
+	ReadHeaderTimeoutConfig      = flag.Duration("read-header-timeout", 5*time.Second, "How long a client may take to send the request headers")
+	ReadTimeoutConfig            = flag.Duration("read-timeout", 30*time.Second, "How long a client may take to send the whole request, including the body")
+	WriteTimeoutConfig           = flag.Duration("write-timeout", 60*time.Second, "How long writing a response may take, counted from the end of the request headers")
+	IdleTimeoutConfig            = flag.Duration("idle-timeout", 2*time.Minute, "How long an idle keep-alive connection is kept open")
+	StorageFormatConfig          = flag.String("storage-format", storageFormatText, "Format of the storage file when it is rewritten, either text or json. Both formats are recognized when reading")
+	RedirectCacheConfig          = flag.Duration("redirect-cache", -1, "How long browsers may cache redirects, sent as Cache-Control max-age. Negative picks it from -redirect-status: a year for 301, no-cache for 302")
+	AccessLogConfig              = flag.Bool("access-log", false, "Log every request with its method, path, status, response size and duration")
+	NotFoundRedirectConfig       = flag.String("notfound-redirect", "", "A base URL that requests for unknown slugs are redirected to, with the path appended. When empty, unknown slugs give a 404")
+	UnixSocketConfig             = flag.String("unix-socket", "", "A Unix domain socket to listen for connections on, for example for a reverse proxy on the same machine")
+	BasePathConfig               = flag.String("base-path", "", "A path prefix the service is mounted under, such as /s. Every endpoint and slug lives under it, and it is added to -server-name in short URLs")
+	MaxSlugsConfig               = flag.Int("max-slugs", 0, "The most slugs that may be stored. Submissions beyond it get 507 Insufficient Storage. Zero means no limit")
+	KeyQuotaConfig               = flag.Int("key-quota", 0, "The most slugs each API key may own, unless the keys file gives a quota after the key. Zero means no limit")
+	StrictCustomSlugConfig       = flag.Bool("strict-custom-slug", false, "Answer 409 Conflict when a requested slug is taken or invalid, instead of generating a random one")
+	NoPersistConfig              = flag.Bool("no-persist", false, "Keep everything in memory only, without reading or writing the storage file. An empty -storage-file does the same")
+	ResolveRequireSecretConfig   = flag.Bool("resolve-require-secret", false, "Require the secret or an API key to look up where short links lead with /resolve")
+	SlugStrategyConfig           = flag.String("slug-strategy", slugStrategyRandom, "How slugs are generated. 'random' picks random slugs, 'sequential' counts upwards in the slug alphabet, giving the shortest slugs but making them guessable")
+	MaxBodyBytesConfig           = flag.Int64("max-body-bytes", 2<<20, "The largest body accepted for posts, such as /submit, bulk submissions and imports. It needs room for URLs as long as -max-storage-line allows. Larger bodies get 413 Request Entity Too Large")
+	SubmitResponseTemplateConfig = flag.String("submit-response-template", "", "Go text/template for plain text submit responses, with {{.ShortURL}}, {{.Slug}} and {{.Target}} - defaults to just the short URL")
+	RejectCaseVariantsConfig     = flag.Bool("reject-case-variants", false, "Answer 409 Conflict when a requested slug differs only in case from an existing one, and never generate such slugs")
+	SlugChecksumConfig           = flag.Bool("slug-checksum", false, "End generated slugs with a check character, so that mistyped links get a 404 suggesting what was meant")
+	LoadInBackgroundConfig       = flag.Bool("load-in-background", false, "Start answering requests before storage has been loaded, with 503 from everything except the health, readiness and version paths until it has")
+	CanonicalHeaderConfig        = flag.Bool("canonical-header", false, "Add a Link header with rel=\"canonical\" pointing at the target to slug redirects, so search engines credit the target")
+	MaxURLLengthConfig           = flag.Int("max-url-length", 8192, "The longest URL in bytes that can be shortened. It can't be raised past what fits in -max-storage-line")
+	StorageBackupsConfig         = flag.Int("storage-backups", 0, "Keep this many earlier versions of the storage file when rewriting it, as .bak, .bak.2 and so on with .bak the newest")
+	LogTargetsConfig             = flag.Bool("log-targets", true, "Log the URLs that slugs lead to. When false only slugs are logged, and the access log leaves out query values and the paths after wildcard slugs")
+	UnlockRateConfig             = flag.Float64("unlock-rate", 0.2, "How many password attempts per second each client may make on average on protected links. Zero disables rate limiting")
+	UnlockBurstConfig            = flag.Int("unlock-burst", 5, "How many password attempts a client may make in a burst before being rate limited")
+	QRRequireSecretConfig        = flag.Bool("qr-require-secret", false, "Require the secret or an API key to fetch QR codes for short links")
+)
+
+const (
+	storageModeRewrite = "rewrite"
+	storageModeAppend  = "append"
+)
+
+const (
+	slugRandomCrypto = "crypto"
+	slugRandomMath   = "math"
 )
 
 // This only supports HEAD and GET requests through shortened URLs
 // POST is reserved to create new shortened URLs
-// It is not safe to run this without TLS - so it should be in front of a reverse proxy
+// It is not safe to run this without TLS - so it should be in front of a reverse proxy, or given -tls-cert and -tls-key
 // The storage format allows for different sizes of the slug. Thus it's possible to change your mind
-// The storage separates the slug from the url using a simple space.
+// In the text format, each line has the slug and the url separated by a tab. Files from before that separated them with a space, and are still read.
+// In append mode the same slug can occur several times in the storage file - the last line wins.
+// Extra information about a slug is stored after the url as tab separated key=value fields. Lines
+// without any fields are still valid.
 
-var storage map[string]string
-var storageReverse map[string]string
+var storage Storage = newMapStorage()
 var storageMutex sync.RWMutex
 
+// Set once storage has been loaded, which with -load-in-background happens while requests are already served
+var storageReady atomic.Bool
+
+// Set when storage has changes that haven't been written yet. Protected by storageMutex
+var storageDirty bool
+
+// Click counts and when each slug was last followed are kept separately, since they are updated while
+// only holding the read lock on storage. Slugs from storage written before access times were recorded
+// have none until they are followed again
+var clicks map[string]uint64
+var lastAccess map[string]time.Time
+var clicksMutex sync.Mutex
+
+// The identity of the API key that created each slug, if any
+var creators map[string]string
+
+// When each expiring slug stops working
+var expiries map[string]time.Time
+
+// When each slug was created, and the address of the client that created it. Slugs from storage
+// written before these were recorded have neither
+var createdAt map[string]time.Time
+var createdFrom map[string]string
+
+// Slugs loaded from the seed file that haven't been changed since, and so are never written to storage
+var seeded map[string]bool
+
+// Slugs that also match longer paths, adding the rest of the path to the target
+var wildcards map[string]bool
+
+// How many more redirects each slug created with a use limit serves before it's removed
+var remainingUses map[string]uint64
+
+// Free text notes given when creating slugs, only for keeping track of what they are for
+var notes map[string]string
+
+const maxNoteLength = 1000
+
+// API keys loaded from the keys file. When empty, the secret is used instead
+var apiKeys []string
+
 func init() {
-	storage = make(map[string]string)
-	storageReverse = make(map[string]string)
+	clicks = make(map[string]uint64)
+	lastAccess = make(map[string]time.Time)
+	notes = make(map[string]string)
+	creators = make(map[string]string)
+	expiries = make(map[string]time.Time)
+	createdAt = make(map[string]time.Time)
+	createdFrom = make(map[string]string)
+	remainingUses = make(map[string]uint64)
+	wildcards = make(map[string]bool)
+	seeded = make(map[string]bool)
 }
 
-func readStorage() {
-	f, e := os.Open(*FilenameStorageConfig)
+// linkMeta is everything kept about a slug besides its URL and click count. Zero values mean no
+// expiry, no password and no use limit
+type linkMeta struct {
+	creator  string
+	expiry   time.Time
+	password string
+	uses     uint64
+	created  time.Time
+	ip       string
+	wildcard bool
+	alias    bool
+	targets  []weightedTarget
+	rules    []uaRule
+	note     string
+	// Only read when loading, since access times are kept with the click counts
+	accessed time.Time
+}
+
+// storedMeta gathers what is kept about the slug, except for its access time. It needs to be called with at
+// least the read lock on storage held
+func storedMeta(slug string) linkMeta {
+	return linkMeta{creator: creators[slug], expiry: expiries[slug], password: passwords[slug], uses: remainingUses[slug],
+		created: createdAt[slug], ip: createdFrom[slug], wildcard: wildcards[slug], alias: aliases[slug],
+		targets: rotations[slug], rules: uaRules[slug], note: notes[slug]}
+}
+
+// setMeta needs to be called with the write lock on storage held
+func setMeta(slug string, meta linkMeta) {
+	if old, ok := creators[slug]; ok {
+		keyUsage[old]--
+	}
+	creators[slug] = meta.creator
+	keyUsage[meta.creator]++
+	delete(expiries, slug)
+	if !meta.expiry.IsZero() {
+		expiries[slug] = meta.expiry
+	}
+	delete(passwords, slug)
+	if meta.password != "" {
+		passwords[slug] = meta.password
+	}
+	delete(remainingUses, slug)
+	if meta.uses > 0 {
+		remainingUses[slug] = meta.uses
+	}
+	delete(createdAt, slug)
+	if !meta.created.IsZero() {
+		createdAt[slug] = meta.created
+	}
+	delete(createdFrom, slug)
+	if meta.ip != "" {
+		createdFrom[slug] = meta.ip
+	}
+	delete(wildcards, slug)
+	if meta.wildcard {
+		wildcards[slug] = true
+	}
+	delete(aliases, slug)
+	if meta.alias {
+		aliases[slug] = true
+	}
+	delete(rotations, slug)
+	if len(meta.targets) > 0 {
+		rotations[slug] = meta.targets
+	}
+	delete(uaRules, slug)
+	if len(meta.rules) > 0 {
+		uaRules[slug] = meta.rules
+	}
+	delete(notes, slug)
+	if meta.note != "" {
+		notes[slug] = meta.note
+	}
+}
+
+// restricted is true for slugs that shouldn't be handed out again for the same URL. It needs to be
+// called with at least the read lock on storage held
+func restricted(slug string) bool {
+	return passwords[slug] != "" || remainingUses[slug] > 0 || wildcards[slug] || len(rotations[slug]) > 0 || len(uaRules[slug]) > 0
+}
+
+// restricted is true for links that should get a slug of their own
+func (meta linkMeta) restricted() bool {
+	return meta.password != "" || meta.uses > 0 || meta.wildcard || len(meta.targets) > 0 || len(meta.rules) > 0
+}
+
+// Storage lines are tab separated, starting with the slug and the URL, followed by name=value fields. Older
+// files separated the slug from the URL with a space instead, and are still read
+const storageSeparators = "\t\r\n"
+
+// legacyStorageLine tells the older lines apart. Those have no tab at all, or a field rather than a URL
+// after the first tab - URLs always have a scheme, so a colon comes before any equals sign
+func legacyStorageLine(columns []string) bool {
+	if len(columns) == 1 {
+		return true
+	}
+	name, _, found := strings.Cut(columns[1], "=")
+	return found && name != "" && strings.Trim(name, "abcdefghijklmnopqrstuvwxyz") == ""
+}
+
+func parseStorageLine(line string) (slug, url string, fields map[string]string, ok bool) {
+	columns := strings.Split(line, "\t")
+	if legacyStorageLine(columns) {
+		pieces := strings.SplitN(columns[0], " ", 2)
+		if len(pieces) != 2 {
+			return "", "", nil, false
+		}
+		columns = append(pieces, columns[1:]...)
+	}
+	if columns[0] == "" || columns[1] == "" {
+		return "", "", nil, false
+	}
+	fields = make(map[string]string)
+	for _, column := range columns[2:] {
+		kv := strings.SplitN(column, "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return columns[0], columns[1], fields, true
+}
+
+func clean(value string) string {
+	return strings.NewReplacer("\n", "", "\t", "").Replace(value)
+}
+
+// escapeField makes free text safe to keep in a storage field, which can't hold separators or line breaks
+func escapeField(value string) string {
+	return url.QueryEscape(value)
+}
+
+func unescapeField(value string) string {
+	unescaped, e := url.QueryUnescape(value)
+	if e != nil {
+		return value
+	}
+	return unescaped
+}
+
+// storageLine fails for a slug or URL that couldn't be read back, or a line too long to be read, rather than
+// writing a broken line. It needs to be called with at least the read lock on storage held
+func storageLine(slug string) (string, error) {
+	url, _ := storage.Get(slug)
+	meta := storedMeta(slug)
+	clicksMutex.Lock()
+	count := clicks[slug]
+	meta.accessed = lastAccess[slug]
+	clicksMutex.Unlock()
+	return formatStorageLine(slug, url, count, meta)
+}
+
+func formatStorageLine(slug, url string, count uint64, meta linkMeta) (string, error) {
+	if strings.ContainsAny(slug, storageSeparators) || strings.ContainsAny(url, storageSeparators) {
+		return "", fmt.Errorf("slug %q or its URL contains a tab or a line break", slug)
+	}
+	line := slug + "\t" + url
+	if count > 0 {
+		line += fmt.Sprintf("\tclicks=%d", count)
+	}
+	if !meta.accessed.IsZero() {
+		line += fmt.Sprintf("\taccessed=%d", meta.accessed.Unix())
+	}
+	if meta.creator != "" {
+		line += fmt.Sprintf("\tkey=%s", meta.creator)
+	}
+	if !meta.expiry.IsZero() {
+		line += fmt.Sprintf("\texpires=%d", meta.expiry.Unix())
+	}
+	if meta.password != "" {
+		line += fmt.Sprintf("\tpassword=%s", meta.password)
+	}
+	if meta.uses > 0 {
+		line += fmt.Sprintf("\tuses=%d", meta.uses)
+	}
+	if !meta.created.IsZero() {
+		line += fmt.Sprintf("\tcreated=%d", meta.created.Unix())
+	}
+	if meta.ip != "" {
+		line += fmt.Sprintf("\tip=%s", clean(meta.ip))
+	}
+	if meta.wildcard {
+		line += "\twildcard=1"
+	}
+	if meta.alias {
+		line += "\talias=1"
+	}
+	if len(meta.targets) > 0 {
+		line += "\ttargets=" + clean(encodeRotation(meta.targets))
+	}
+	if len(meta.rules) > 0 {
+		line += "\trules=" + clean(encodeUARules(meta.rules))
+	}
+	// Notes are free text, so they are escaped rather than cleaned of anything that would break the line
+	if meta.note != "" {
+		line += "\tnote=" + escapeField(meta.note)
+	}
+	// Lines this long would be skipped when reading, which several long rotation targets can add up to
+	if len(line) > *MaxStorageLineConfig {
+		return "", fmt.Errorf("the line for slug %q is %d bytes, longer than -max-storage-line", slug, len(line))
+	}
+	return line, nil
+}
+
+// validateLine makes sure that a new link will fit in a storage line, even once it has been clicked a lot.
+// Without a requested slug, room is left for the longest slug that can be generated
+func validateLine(slug, url string, meta linkMeta) error {
+	if slug == "" {
+		slug = strings.Repeat("x", *MaxSlugLengthConfig)
+	}
+	meta.accessed = time.Now()
+	if _, e := formatStorageLine(slug, url, math.MaxUint64, meta); e != nil {
+		return fmt.Errorf("the link is too long to store - it has to fit in %d bytes", *MaxStorageLineConfig)
+	}
+	return nil
+}
+
+// writeStorageLine writes the line for the slug, leaving out slugs that would break the storage format
+func writeStorageLine(out io.Writer, slug string) {
+	line, e := storageLine(slug)
 	if e != nil {
-		// No file exists, probably
+		slog.Error("not writing slug to storage", "error", e)
 		return
 	}
+	fmt.Fprintf(out, "%s\n", line)
+}
+
+// loadEntry puts a slug read from a backend into storage, replacing any earlier entry for the same slug
+func loadEntry(slug, url string, count uint64, meta linkMeta) {
+	storeSlug(slug, url, meta.alias || meta.restricted())
+	clicks[slug] = count
+	delete(lastAccess, slug)
+	if !meta.accessed.IsZero() {
+		lastAccess[slug] = meta.accessed
+	}
+	setMeta(slug, meta)
+	delete(seeded, slug)
+}
+
+// slugFolder lower cases the slugs read from a backend with -case-insensitive, since lookups are lower cased
+// too and slugs created before it was turned on could otherwise never be found. It remembers the slugs it
+// has seen, by their lower case form, to warn about slugs that can no longer be told apart. The last of
+// those wins, the same as when a slug is read twice
+type slugFolder map[string]string
+
+func (f slugFolder) fold(slug string) string {
+	if !*CaseInsensitiveConfig {
+		return slug
+	}
+	folded := strings.ToLower(slug)
+	if previous, ok := f[folded]; ok && previous != slug {
+		slog.Warn("slugs only differ in case, so with -case-insensitive the last one replaces the other",
+			"slug", slug, "replaced", previous)
+	}
+	f[folded] = slug
+	return folded
+}
+
+// persistenceDisabled is true with -no-persist or an empty -storage-file, when everything only lives in memory
+func persistenceDisabled() bool {
+	return *NoPersistConfig || *FilenameStorageConfig == ""
+}
+
+func readStorage() {
+	if persistenceDisabled() {
+		return
+	}
+	readStorageFile(*FilenameStorageConfig, false)
+}
+
+// readSeed loads the seed file, which has to happen before the storage is read so that the storage wins
+func readSeed() {
+	if *SeedFileConfig != "" {
+		readStorageFile(*SeedFileConfig, true)
+	}
+}
+
+func readStorageFile(name string, seed bool) {
+	contents, e := parseStorageFile(name)
+	if e != nil {
+		slog.Error("reading storage file", "file", name, "error", e)
+	}
+	contents.load(seed)
+}
+
+// storedEntry is a slug as read from a storage file
+type storedEntry struct {
+	slug, url string
+	count     uint64
+	meta      linkMeta
+}
+
+// storageContents is everything read from a storage file. Reading doesn't touch storage, so it can be
+// done without holding the lock, leaving only load to be done with it
+type storageContents struct {
+	entries  []storedEntry
+	sequence uint64
+}
+
+func (c *storageContents) add(slug, url string, count uint64, meta linkMeta) {
+	c.entries = append(c.entries, storedEntry{slug, url, count, meta})
+}
+
+// load puts the contents into storage, with later entries for a slug replacing earlier ones. It needs
+// to be called with the write lock on storage held
+func (c *storageContents) load(seed bool) {
+	folder := make(slugFolder)
+	for _, entry := range c.entries {
+		slug := folder.fold(entry.slug)
+		loadEntry(slug, entry.url, entry.count, entry.meta)
+		if seed {
+			seeded[slug] = true
+		}
+	}
+	nextSequence = max(nextSequence, c.sequence)
+}
+
+// parseStorageFile reads a storage file in either format. A file that doesn't exist is empty, and when
+// reading fails, everything read before the failure is returned along with the error
+func parseStorageFile(name string) (*storageContents, error) {
+	contents := &storageContents{}
+	f, e := os.Open(name)
+	if os.IsNotExist(e) {
+		return contents, nil
+	} else if e != nil {
+		return contents, e
+	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		pieces := strings.SplitN(scanner.Text(), " ", 2)
-		if len(pieces) == 2 {
-			storage[pieces[0]] = pieces[1]
-			storageReverse[pieces[1]] = pieces[0]
+	var r io.Reader = f
+	if compressedStorage(name) {
+		gz, e := gzip.NewReader(f)
+		if e == io.EOF {
+			// An empty file, which append mode can leave behind
+			return contents, nil
+		} else if e != nil {
+			return contents, fmt.Errorf("reading compressed storage file: %v", e)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// Either format is read, whatever -storage-format says, so that switching format only takes a restart
+	buffered := bufio.NewReader(r)
+	if jsonStorage(buffered) {
+		if e := readJSONStorage(buffered, name, contents); e != nil {
+			return contents, fmt.Errorf("reading JSON storage file: %v", e)
 		}
+		return contents, nil
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "reading storage file: %s - %v\n", *FilenameStorageConfig, err)
+
+	tooLong := func(number int) {
+		slog.Warn("skipping storage line longer than -max-storage-line", "file", name, "line", number, "max", *MaxStorageLineConfig)
+	}
+	e = readLines(buffered, *MaxStorageLineConfig, tooLong, func(line string) {
+		if sequence, ok := parseSequenceLine(line); ok {
+			contents.sequence = max(contents.sequence, sequence)
+			return
+		}
+		slug, url, fields, ok := parseStorageLine(line)
+		if ok {
+			count, _ := strconv.ParseUint(fields["clicks"], 10, 64)
+			meta := linkMeta{creator: fields["key"], password: fields["password"], ip: fields["ip"], wildcard: fields["wildcard"] == "1", alias: fields["alias"] == "1"}
+			if expires, e := strconv.ParseInt(fields["expires"], 10, 64); e == nil {
+				meta.expiry = time.Unix(expires, 0)
+			}
+			if created, e := strconv.ParseInt(fields["created"], 10, 64); e == nil {
+				meta.created = time.Unix(created, 0)
+			}
+			if accessed, e := strconv.ParseInt(fields["accessed"], 10, 64); e == nil {
+				meta.accessed = time.Unix(accessed, 0)
+			}
+			meta.uses, _ = strconv.ParseUint(fields["uses"], 10, 64)
+			meta.targets = decodeRotation(fields["targets"])
+			meta.rules = decodeUARules(fields["rules"])
+			meta.note = unescapeField(fields["note"])
+			contents.add(slug, url, count, meta)
+		}
+	})
+	return contents, e
+}
+
+// readLines calls line for each line read, or tooLong with the line number for lines longer than max bytes.
+// Unlike bufio.Scanner, it carries on after a line that is too long
+func readLines(r io.Reader, max int, tooLong func(number int), line func(string)) error {
+	reader := bufio.NewReader(r)
+	var buffer []byte
+	skipping := false
+	for number := 1; ; {
+		chunk, more, e := reader.ReadLine()
+		if e == io.EOF {
+			return nil
+		} else if e != nil {
+			return e
+		}
+		if !skipping {
+			buffer = append(buffer, chunk...)
+			skipping = len(buffer) > max
+		}
+		if more {
+			continue
+		}
+
+		if skipping {
+			tooLong(number)
+		} else {
+			line(string(buffer))
+		}
+		buffer = buffer[:0]
+		skipping = false
+		number++
 	}
 }
 
@@ -67,112 +615,1972 @@ func fileExists(filename string) bool {
 	return err == nil
 }
 
-func writeStorage() {
+// Storage files with a .gz extension are compressed. Appends add another gzip member to the end of the
+// file, which readers treat as a continuation of the same stream
+func compressedStorage(name string) bool {
+	return strings.HasSuffix(name, ".gz")
+}
+
+// backupName gives the name of the nth backup of the storage file, where the first is the newest
+func backupName(name string, n int) string {
+	if n == 1 {
+		return name + ".bak"
+	}
+	return fmt.Sprintf("%s.bak.%d", name, n)
+}
+
+// backupStorage shifts the backups along, dropping the oldest, and makes the current storage file the newest
+// one. That's a hard link, so the storage file stays in place until the rename replaces it
+func backupStorage(name string) error {
+	if *StorageBackupsConfig <= 0 || !fileExists(name) {
+		return nil
+	}
+	for n := *StorageBackupsConfig; n > 1; n-- {
+		if e := os.Rename(backupName(name, n-1), backupName(name, n)); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+	}
+	if e := os.Remove(backupName(name, 1)); e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	return os.Link(name, backupName(name, 1))
+}
+
+// writeStorage rewrites the whole storage file. Everything goes to a temporary file first, which only
+// replaces the storage file once it has been written completely, and which is removed if anything fails
+func writeStorage() (e error) {
+	if persistenceDisabled() {
+		storageDirty = false
+		return nil
+	}
+	defer func() {
+		storageWriteError = e
+	}()
 	name := *FilenameStorageConfig
 	aname, _ := filepath.Abs(name)
 	dir := filepath.Dir(aname)
 	f, e := ioutil.TempFile(dir, "goshort-storage")
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "creating temporary storage file: %v\n", e)
-		return
+		return fmt.Errorf("creating temporary storage file: %v", e)
+	}
+	defer func() {
+		if e != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	// Errors stick to the buffered writer, so the write only has to be checked once, at the end
+	buffered := bufio.NewWriter(f)
+	var out io.Writer = buffered
+	var gz *gzip.Writer
+	if compressedStorage(name) {
+		gz = gzip.NewWriter(buffered)
+		out = gz
+	}
+	unseeded := func(f func(slug string)) {
+		storage.Each(func(slug, url string) {
+			if !seeded[slug] {
+				f(slug)
+			}
+		})
+	}
+	if *StorageFormatConfig == storageFormatJSON {
+		if e := writeJSONStorage(out, unseeded); e != nil {
+			return fmt.Errorf("writing JSON to temporary storage file: %v", e)
+		}
+	} else {
+		if nextSequence > 0 {
+			fmt.Fprintf(out, "%s\n", sequenceLine())
+		}
+		unseeded(func(slug string) {
+			writeStorageLine(out, slug)
+		})
+	}
+	if gz != nil {
+		if e := gz.Close(); e != nil {
+			return fmt.Errorf("compressing temporary storage file: %v", e)
+		}
+	}
+	if e := buffered.Flush(); e != nil {
+		return fmt.Errorf("writing temporary storage file: %v", e)
 	}
 
-	for slug, url := range storage {
-		fmt.Fprintf(f, "%s %s\n", slug, strings.Replace(url, "\n", "", -1))
+	// The data has to be on disk before the rename, or a crash could leave an empty storage file behind
+	if e := f.Sync(); e != nil {
+		return fmt.Errorf("syncing temporary storage file: %v", e)
 	}
+	if e := f.Close(); e != nil {
+		return fmt.Errorf("closing temporary storage file: %v", e)
+	}
+
+	if e := backupStorage(name); e != nil {
+		slog.Warn("backing up storage file", "file", name, "error", e)
+	}
+	// Rename replaces the old file atomically, so there is never a moment without a storage file
+	if e := os.Rename(f.Name(), name); e != nil {
+		return fmt.Errorf("renaming temporary storage file to %s: %v", name, e)
+	}
+	syncDir(dir)
+	storageDirty = false
+	return nil
+}
+
+// The error from the last rewrite of the storage file, or nil if it succeeded. While the rewrites fail,
+// saving new slugs fails too, since they would only be kept in memory. Protected by storageMutex
+var storageWriteError error
 
+// checkStorageWritable makes sure that the storage file can be written, by creating a file next to it,
+// so that a directory without write permission is noticed at startup rather than at the first write
+func checkStorageWritable() error {
+	if *StorageBackendConfig != storageBackendFile || persistenceDisabled() {
+		return nil
+	}
+	name, _ := filepath.Abs(*FilenameStorageConfig)
+	f, e := os.CreateTemp(filepath.Dir(name), "goshort-check")
+	if e != nil {
+		return e
+	}
 	f.Close()
+	os.Remove(f.Name())
+	if fileExists(name) && *StorageModeConfig == storageModeAppend {
+		// Appends write to the file itself rather than replacing it
+		f, e := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+		if e != nil {
+			return e
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// logStorageError logs a failed rewrite of the storage file. The changes stay pending, so the next
+// flush tries again
+func logStorageError(e error) {
+	if e != nil {
+		slog.Error("writing storage file", "file", *FilenameStorageConfig, "error", e)
+	}
+}
 
-	if fileExists(name) {
-		os.Remove(name)
+// syncDir makes a rename in the directory durable
+func syncDir(dir string) {
+	d, e := os.Open(dir)
+	if e != nil {
+		slog.Error("opening storage directory", "error", e)
+		return
 	}
+	defer d.Close()
+	if e := d.Sync(); e != nil {
+		slog.Error("syncing storage directory", "error", e)
+	}
+}
 
-	os.Rename(f.Name(), name)
+// markDirty schedules a rewrite of the storage file. It needs to be called with the write lock on storage held
+func markDirty() {
+	storageDirty = true
+	changesMade.Add(1)
 }
 
-const allSlugPossibilities = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+// With a zero flush interval, every change is written before the request making it completes. The write
+// happens once the storage lock has been released, and requests that come in while a write is running
+// share the next one, so that a burst of changes doesn't turn into one full rewrite per change
+var flushMutex sync.Mutex
+var flushDone = sync.NewCond(&flushMutex)
+var flushRunning bool
 
-func oneSlugEntry() rune {
-	return rune(allSlugPossibilities[rand.Intn(len(allSlugPossibilities))])
+// Counts of changes made and of changes known to be on disk, protected by flushMutex for writing
+var changesMade, changesWritten atomic.Uint64
+
+// The error from the last write done by flushStorage, protected by flushMutex
+var flushError error
+
+// flushStorage returns once all changes made before it was called are written, with the error from the
+// write that covered them. It must be called without holding the lock on storage
+func flushStorage() error {
+	flushMutex.Lock()
+	defer flushMutex.Unlock()
+
+	wanted := changesMade.Load()
+	for changesWritten.Load() < wanted {
+		if flushRunning {
+			flushDone.Wait()
+			continue
+		}
+		flushRunning = true
+		flushMutex.Unlock()
+
+		storageMutex.Lock()
+		covered := changesMade.Load()
+		var e error
+		if storageDirty {
+			e = writeStorage()
+			logStorageError(e)
+		}
+		storageMutex.Unlock()
+
+		flushMutex.Lock()
+		flushRunning = false
+		flushError = e
+		changesWritten.Store(covered)
+		flushDone.Broadcast()
+	}
+	return flushError
 }
 
-func genSlug() string {
-	entries := make([]rune, *SpaceConfig)
-	for ix := range entries {
-		entries[ix] = oneSlugEntry()
+// syncStorage writes pending changes when the flush interval is zero. It must be called without holding
+// the lock on storage
+func syncStorage() {
+	if *FlushIntervalConfig == 0 && changesWritten.Load() < changesMade.Load() {
+		flushStorage()
 	}
-	return string(entries)
 }
 
-func genUniqueSlug() string {
-	ix := 0
-	for ix < 100000 {
-		s := genSlug()
-		if _, ok := storage[s]; !ok {
-			return s
+// rewriteDeferred is true when saving new slugs leaves rewriting the storage file to flushStorage, once
+// the lock on storage has been released
+func rewriteDeferred() bool {
+	_, file := activeBackend.(fileBackend)
+	return file && *StorageModeConfig != storageModeAppend && *FlushIntervalConfig == 0
+}
+
+// awaitStored waits for the rewrite covering newly created slugs when saving them deferred it, so that a
+// burst of submissions shares rewrites. When that rewrite fails the slugs are taken back and errNotStored
+// is returned, the same as when saving fails right away. It must be called without holding the lock on storage
+func awaitStored(slugs ...string) error {
+	if len(slugs) == 0 || !rewriteDeferred() || flushStorage() == nil {
+		return nil
+	}
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	for _, slug := range slugs {
+		removeSlug(slug)
+		persistRemoval(slug)
+	}
+	return errNotStored
+}
+
+func flushPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		storageMutex.Lock()
+		if storageDirty {
+			logStorageError(writeStorage())
 		}
-		ix += 1
+		storageMutex.Unlock()
 	}
-	panic("Tried generating 100,000 slugs, and couldn't find one...")
 }
 
-func invalidSlug(slug string) bool {
-	for _, char := range slug {
-		if !strings.Contains(allSlugPossibilities, string(char)) {
-			return true
+func appendStorage(slugs ...string) error {
+	if persistenceDisabled() {
+		return nil
+	}
+	f, e := os.OpenFile(*FilenameStorageConfig, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if e != nil {
+		return fmt.Errorf("opening storage file for append: %v", e)
+	}
+	defer f.Close()
+
+	var lines bytes.Buffer
+	var out io.Writer = &lines
+	var gz *gzip.Writer
+	if compressedStorage(*FilenameStorageConfig) {
+		gz = gzip.NewWriter(&lines)
+		out = gz
+	}
+	for _, slug := range slugs {
+		writeStorageLine(out, slug)
+	}
+	if nextSequence > 0 {
+		fmt.Fprintf(out, "%s\n", sequenceLine())
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	if _, e := f.Write(lines.Bytes()); e != nil {
+		return fmt.Errorf("appending to storage file: %v", e)
+	}
+	if e := f.Sync(); e != nil {
+		return fmt.Errorf("syncing storage file: %v", e)
+	}
+	return nil
+}
+
+// saveStorage persists newly created slugs according to the configured storage mode. Rewrites happen
+// later - with a zero flush interval callers wait for them with awaitStored, otherwise saving can only
+// fail when the last rewrite did
+func saveStorage(slugs ...string) error {
+	if *StorageModeConfig == storageModeAppend {
+		return appendStorage(slugs...)
+	}
+	markDirty()
+	if *FlushIntervalConfig == 0 {
+		return nil
+	}
+	return storageWriteError
+}
+
+// compactStorage rewrites the storage file, collapsing all duplicate lines left behind by append mode
+func compactStorage() {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	logStorageError(writeStorage())
+}
+
+func compactPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		compactStorage()
+	}
+}
+
+const allSlugPossibilities = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+const lowerSlugPossibilities = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Characters that can be used in a URL path without escaping
+const unreservedCharacters = allSlugPossibilities + "-._~"
+
+// validateAlphabet checks that -slug-alphabet can be used for slugs
+func validateAlphabet(alphabet string) error {
+	seen := make(map[rune]bool)
+	for _, char := range alphabet {
+		if !strings.ContainsRune(unreservedCharacters, char) {
+			return fmt.Errorf("character %q isn't allowed - only letters, digits and -._~ are", char)
+		}
+		if seen[char] {
+			return fmt.Errorf("character %q occurs more than once", char)
 		}
+		if *CaseInsensitiveConfig && unicode.IsUpper(char) {
+			return fmt.Errorf("character %q is upper case, which can't be used with -case-insensitive", char)
+		}
+		seen[char] = true
 	}
-	return false
+	if len(seen) < 2 {
+		return errors.New("at least two characters are needed")
+	}
+	return nil
 }
 
-func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	flag.Parse()
-	readStorage()
-	fmt.Fprintf(os.Stdout, "GoShort starting... we have %d URLs shortened so far\n", len(storage))
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		purl, _ := url.ParseRequestURI(r.RequestURI)
-		path := purl.Path
-
-		if r.Method == "POST" && path == "/submit" {
-			secret := r.PostFormValue("secret")
-			url := r.PostFormValue("url")
-			slug := r.PostFormValue("slug")
-			if secret == *SecretConfig && url != "" {
-				storageMutex.Lock()
-				defer storageMutex.Unlock()
-
-				existingSlug, existsReverse := storageReverse[url]
-				if existsReverse {
-					w.Write([]byte(fmt.Sprintf("%s/%s", *ServerNameConfig, existingSlug)))
-				} else {
-					_, exists := storage[slug]
-					if slug == "" || invalidSlug(slug) || exists {
-						slug = genUniqueSlug()
-					}
-					storage[slug] = url
-					writeStorage()
-					w.Write([]byte(fmt.Sprintf("%s/%s", *ServerNameConfig, slug)))
-					fmt.Fprintf(os.Stdout, " - added new shortening: %s for %s\n", slug, url)
-				}
-			} else {
-				http.Error(w, "Not authorized", http.StatusUnauthorized)
-			}
-		} else if r.Method == "GET" || r.Method == "HEAD" {
-			slug := strings.TrimPrefix(path, "/")
-			storageMutex.RLock()
-			url, ok := storage[slug]
-			storageMutex.RUnlock()
-			if ok {
-				http.Redirect(w, r, string(url), http.StatusMovedPermanently)
-			} else {
-				http.NotFound(w, r)
-			}
-		} else {
-			http.NotFound(w, r)
+func slugPossibilities() string {
+	if *SlugAlphabetConfig != "" {
+		return *SlugAlphabetConfig
+	}
+	if *CaseInsensitiveConfig {
+		return lowerSlugPossibilities
+	}
+	return allSlugPossibilities
+}
+
+// Slugs that would shadow endpoints, or that were reserved with -reserved-slugs
+var reservedSlugs = make(map[string]bool)
+
+var errReservedSlug = errors.New("slug is reserved")
+var errSlugLength = errors.New("slug length out of range")
+var errCaseVariant = errors.New("a slug differing only in case is already in use")
+
+// caseVariantTaken is true when -reject-case-variants keeps the slug from being created, because another
+// slug only differs from it in case. It needs to be called with at least the read lock on storage held
+func caseVariantTaken(slug string) bool {
+	return *RejectCaseVariantsConfig && !*CaseInsensitiveConfig && storage.HasCaseVariant(slug)
+}
+
+var errStorageFull = errors.New("the maximum number of slugs has been reached")
+var errNotStored = errors.New("the link couldn't be persisted")
+
+func slugLengthMessage() string {
+	return fmt.Sprintf("Slug must be between %d and %d characters", *MinSlugLengthConfig, *MaxSlugLengthConfig)
+}
+
+func reserveSlugs() {
+	paths := []string{"submit", "bulk", "alias", "update", "delete", "stats", "admin", "export", "import", "qr", "resolve", "version", "auth-check", *HealthPathConfig, *ReadyPathConfig, *MetricsPathConfig}
+	for _, slug := range append(paths, strings.Split(*ReservedSlugsConfig, ",")...) {
+		slug = strings.SplitN(strings.Trim(strings.TrimSpace(slug), "/"), "/", 2)[0]
+		if slug != "" {
+			reservedSlugs[normalizeSlug(slug)] = true
 		}
-	})
+	}
+}
 
-	log.Fatal(http.ListenAndServe(net.JoinHostPort(*ListenHostConfig, *ListenPortConfig), nil))
+// Lower cased words that generated slugs must not contain
+var blockedWords []string
+
+func readBlocklist() error {
+	f, e := os.Open(*SlugBlocklistConfig)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word != "" && !strings.HasPrefix(word, "#") {
+			blockedWords = append(blockedWords, word)
+		}
+	}
+	return scanner.Err()
+}
+
+func blockedSlug(slug string) bool {
+	lower := strings.ToLower(slug)
+	for _, word := range blockedWords {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeSlug should be applied to all slugs coming from clients
+func normalizeSlug(slug string) string {
+	if *CaseInsensitiveConfig {
+		return strings.ToLower(slug)
+	}
+	return slug
+}
+
+// Only used with the math random source. It is seeded from crypto/rand at startup and protected by storageMutex
+var mathRand *mrand.Rand
+
+func seedMathRand() {
+	var seed [8]byte
+	if _, e := rand.Read(seed[:]); e != nil {
+		fatal("seeding random source", "error", e)
+	}
+	mathRand = mrand.New(mrand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+}
+
+func randomIndex(n int) int {
+	if *SlugRandomConfig == slugRandomMath {
+		return mathRand.Intn(n)
+	}
+	ix, e := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if e != nil {
+		panic(fmt.Sprintf("reading from crypto/rand: %v", e))
+	}
+	return int(ix.Int64())
+}
+
+func oneSlugEntry() rune {
+	possibilities := slugPossibilities()
+	return rune(possibilities[randomIndex(len(possibilities))])
+}
+
+// The length of generated slugs. It starts out as -space, but grows when it gets hard to find free slugs.
+// Protected by storageMutex
+var slugLength int
+
+// Set once the utilization warning has been logged for the current slug length. Protected by storageMutex
+var utilizationWarned bool
+
+// slugSpaceUtilization is the share of all possible slugs of the generated length that are in use. It
+// counts every slug, whatever its length, so it errs on the high side. It needs to be called with at
+// least the read lock on storage held
+func slugSpaceUtilization() float64 {
+	length := slugLength
+	if length < *SpaceConfig {
+		length = *SpaceConfig
+	}
+	if length < *MinSlugLengthConfig {
+		length = *MinSlugLengthConfig
+	}
+	// The check character doesn't add any possibilities
+	if *SlugChecksumConfig {
+		length--
+	}
+	utilization := float64(storage.Len()) / math.Pow(float64(len(slugPossibilities())), float64(length))
+	return math.Min(utilization, 1)
+}
+
+// warnUtilization logs once per slug length when generating slugs is getting expensive. It needs to
+// be called with the write lock on storage held
+func warnUtilization() {
+	utilization := slugSpaceUtilization()
+	if utilizationWarned || utilization < *UtilizationWarningConfig {
+		return
+	}
+	utilizationWarned = true
+	generated := slugsGeneratedTotal.Load()
+	average := float64(generated+slugCollisionsTotal.Load()) / float64(generated)
+	slog.Warn("slug space is getting full - consider a larger -space", "length", slugLength,
+		"utilization", utilization, "average_attempts", average)
+}
+
+// newSlug generates a random slug of the length, with the last character being the check character
+// when -slug-checksum is used
+func newSlug(length int) string {
+	if *SlugChecksumConfig {
+		return withChecksum(genSlug(max(length-1, 1)))
+	}
+	return genSlug(length)
+}
+
+func genSlug(length int) string {
+	entries := make([]rune, length)
+	for ix := range entries {
+		entries[ix] = oneSlugEntry()
+	}
+	return string(entries)
+}
+
+// genUniqueSlug needs to be called with the write lock on storage held. A dry run gives a slug the same way,
+// but leaves the generated length, the sequence and the metrics alone
+func genUniqueSlug(dryRun bool) (string, error) {
+	if *SlugStrategyConfig == slugStrategySequential {
+		return genSequentialSlug(dryRun)
+	}
+	length := max(slugLength, *SpaceConfig, *MinSlugLengthConfig)
+	maxLength := *SpaceConfig + *SlugGrowthConfig
+	if maxLength > *MaxSlugLengthConfig {
+		maxLength = *MaxSlugLengthConfig
+	}
+	for {
+		if !dryRun {
+			slugLength = length
+		}
+		for ix := 0; ix < *SlugAttemptsConfig; ix++ {
+			s := newSlug(length)
+			if _, ok := storage.Get(s); !ok && !reservedSlugs[s] && !blockedSlug(s) && !caseVariantTaken(s) {
+				if !dryRun {
+					slugsGeneratedTotal.Add(1)
+					warnUtilization()
+				}
+				return s, nil
+			}
+			if !dryRun {
+				slugCollisionsTotal.Add(1)
+			}
+		}
+		if length >= maxLength {
+			return "", fmt.Errorf("tried generating %d slugs of length %d, and couldn't find a free one", *SlugAttemptsConfig, length)
+		}
+		length++
+		if !dryRun {
+			utilizationWarned = false
+			slog.Warn("slug space is filling up, growing generated slugs - consider a larger -space", "length", length)
+		}
+	}
+}
+
+func invalidSlug(slug string) bool {
+	for _, char := range slug {
+		if !strings.Contains(slugPossibilities(), string(char)) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedScheme(scheme string) bool {
+	for _, allowed := range strings.Split(*AllowedSchemesConfig, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTarget rewrites the URL to one canonical spelling when -normalize-urls is given. URLs that
+// don't parse are left alone for validateTarget to reject
+func normalizeTarget(target string) string {
+	if !*NormalizeURLsConfig {
+		return target
+	}
+	u, e := url.Parse(target)
+	if e != nil || u.Host == "" {
+		return target
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+
+	if *StripSlashConfig {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+	} else if u.Path == "" {
+		u.Path = "/"
+	}
+	if *SortQueryConfig && u.RawQuery != "" {
+		// Encode sorts by key
+		u.RawQuery = u.Query().Encode()
+	}
+	return u.String()
+}
+
+// Room left in a storage line for the slug and the fields after the URL
+const storageLineOverhead = 1024
+
+// maxURLLength gives the limit from -max-url-length, lowered when needed to leave room for the rest of the
+// storage line
+func maxURLLength() int {
+	return min(*MaxURLLengthConfig, *MaxStorageLineConfig-storageLineOverhead)
+}
+
+// validateTarget makes sure that a URL submitted for shortening is something we are happy redirecting to
+func validateTarget(target string) error {
+	if max := maxURLLength(); len(target) > max {
+		return fmt.Errorf("URL is too long - it is %d bytes, and the maximum is %d", len(target), max)
+	}
+	// Whitespace and control characters would break the storage format, and have to be percent-encoded
+	if ix := strings.IndexFunc(target, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }); ix != -1 {
+		return fmt.Errorf("URL contains whitespace or a control character at position %d - these must be percent-encoded", ix)
+	}
+	u, e := url.Parse(target)
+	if e != nil {
+		return fmt.Errorf("invalid URL: %v", e)
+	}
+	if !allowedScheme(u.Scheme) {
+		return fmt.Errorf("URL scheme not allowed: %q - accepted schemes are %s", u.Scheme, *AllowedSchemesConfig)
+	}
+	if u.Host == "" {
+		return errors.New("URL must contain a host")
+	}
+	if ownHost(u) {
+		return errors.New("URL points back at this shortener, which would make a redirect loop")
+	}
+	if *BlockPrivateConfig {
+		return validatePublicHost(u.Hostname())
+	}
+	return nil
+}
+
+// ownHost is true when the URL is on the host of -server-name, whatever the scheme and with default ports ignored.
+// With -base-path, only URLs under the base path count, since the rest of the host belongs to something else
+func ownHost(u *url.URL) bool {
+	own, e := url.Parse(*ServerNameConfig)
+	if e != nil || own.Host == "" {
+		return false
+	}
+	base := *BasePathConfig
+	underBase := base == "" || u.Path == base || strings.HasPrefix(u.Path, base+"/")
+	return underBase && strings.EqualFold(hostWithoutDefaultPort(u), hostWithoutDefaultPort(own))
+}
+
+func hostWithoutDefaultPort(u *url.URL) string {
+	if port := u.Port(); port == "80" || port == "443" {
+		return u.Hostname()
+	}
+	return u.Host
+}
+
+func privateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// validatePublicHost rejects hosts that are, or resolve to, addresses that aren't reachable on the public internet
+func validatePublicHost(host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var e error
+		if ips, e = net.LookupIP(host); e != nil {
+			return fmt.Errorf("could not resolve host: %s", host)
+		}
+	}
+	for _, ip := range ips {
+		if privateIP(ip) {
+			return fmt.Errorf("URL host is not a public address: %s", host)
+		}
+	}
+	return nil
+}
+
+// trustedProxy reports whether the address belongs to one of the configured reverse proxies
+func trustedProxy(ip net.IP) bool {
+	for _, proxy := range strings.Split(*TrustedProxyConfig, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if _, network, e := net.ParseCIDR(proxy); e == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client making the request. When the request comes through a
+// trusted proxy, X-Forwarded-For is followed back to the first address not belonging to a proxy
+func clientIP(r *http.Request) string {
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
+		host = r.RemoteAddr
+	}
+	if *TrustedProxyConfig == "" {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for ix := len(forwarded) - 1; ix >= 0; ix-- {
+		ip := net.ParseIP(host)
+		if ip == nil || !trustedProxy(ip) {
+			break
+		}
+		if next := strings.TrimSpace(forwarded[ix]); next != "" {
+			host = next
+		}
+	}
+	return host
+}
+
+func readKeys() error {
+	f, e := os.Open(*KeysFileConfig)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	// Each line is a key, optionally followed by the most slugs it may create
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key := fields[0]
+		apiKeys = append(apiKeys, key)
+		if len(fields) > 1 {
+			quota, e := strconv.Atoi(fields[1])
+			if e != nil || quota < 0 {
+				return fmt.Errorf("invalid quota for key %s: %q", keyID(key), fields[1])
+			}
+			keyQuotas[keyID(key)] = quota
+		}
+	}
+	return scanner.Err()
+}
+
+// keyID gives an identity for an API key that can be stored without revealing the key itself
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// authenticate returns the identity of the API key matching the secret given. When no keys file
+// is used, the identity is empty. All comparisons are done in constant time, to not leak
+// information about the keys through timing
+func authenticate(secret string) (id string, ok bool) {
+	if len(apiKeys) == 0 {
+		return "", subtle.ConstantTimeCompare([]byte(secret), []byte(*SecretConfig)) == 1
+	}
+	for _, key := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(key)) == 1 {
+			id, ok = keyID(key), true
+		}
+	}
+	return id, ok
+}
+
+// requestSecret gives the secret from the form, or when there is none the password of HTTP Basic auth,
+// for clients that would rather not put it in the form. The user name is ignored
+func requestSecret(r *http.Request, secret string) string {
+	if secret != "" {
+		return secret
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// notAuthorized answers 401, inviting clients to retry with Basic auth
+func notAuthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="GoShort", charset="UTF-8"`)
+	http.Error(w, "Not authorized", http.StatusUnauthorized)
+}
+
+func validSecret(secret string) bool {
+	_, ok := authenticate(secret)
+	return ok
+}
+
+// resetStorage forgets every slug. The sequence counter is kept, so that numbers are still never reused.
+// It needs to be called with the write lock on storage held
+func resetStorage() {
+	storage = newMapStorage()
+	clicksMutex.Lock()
+	clear(clicks)
+	clear(lastAccess)
+	clicksMutex.Unlock()
+	clear(creators)
+	clear(expiries)
+	clear(passwords)
+	clear(remainingUses)
+	clear(createdAt)
+	clear(createdFrom)
+	clear(wildcards)
+	clear(aliases)
+	clear(rotations)
+	clear(uaRules)
+	clear(notes)
+	clear(seeded)
+	clear(keyUsage)
+}
+
+// removeSlug needs to be called with the write lock on storage held
+func removeSlug(slug string) {
+	url, _ := storage.Get(slug)
+	storage.Delete(slug)
+	promoteAlias(url)
+	clicksMutex.Lock()
+	delete(clicks, slug)
+	delete(lastAccess, slug)
+	clicksMutex.Unlock()
+	if creator, ok := creators[slug]; ok {
+		keyUsage[creator]--
+	}
+	delete(creators, slug)
+	delete(expiries, slug)
+	delete(passwords, slug)
+	delete(remainingUses, slug)
+	delete(createdAt, slug)
+	delete(createdFrom, slug)
+	delete(wildcards, slug)
+	delete(aliases, slug)
+	delete(rotations, slug)
+	delete(uaRules, slug)
+	delete(notes, slug)
+	delete(seeded, slug)
+}
+
+// deleteSlug removes the slug from both the storage and the reverse storage, and persists the result.
+// It returns false if the slug doesn't exist
+func deleteSlug(slug string) bool {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	url, ok := storage.Get(slug)
+	if !ok {
+		return false
+	}
+	removeSlug(slug)
+	persistRemoval(slug)
+	slog.Info("removed shortening", "slug", slug, targetAttr("target", url))
+	return true
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, slug string) {
+	if !validSecret(requestSecret(r, r.FormValue("secret"))) {
+		notAuthorized(w)
+		return
+	}
+	if !deleteSlug(slug) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("Deleted %s/%s", serverName(r), slug)))
+}
+
+// updateSlug points an existing slug at a new URL and persists the change, which also stops a rotating
+// slug from rotating. It returns false if the slug doesn't exist, and fails when the slug's storage line
+// would get too long
+func updateSlug(slug, url string) (bool, error) {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	old, ok := storage.Get(slug)
+	if !ok {
+		return false, nil
+	}
+	meta := storedMeta(slug)
+	meta.targets = nil
+	if e := validateLine(slug, url, meta); e != nil {
+		return true, e
+	}
+	delete(rotations, slug)
+	storeSlug(slug, url, aliases[slug] || restricted(slug))
+	promoteAlias(old)
+	persistSlugs(slug)
+	slog.Info("updated shortening", "slug", slug, targetAttr("old_target", old), targetAttr("target", url))
+	return true, nil
+}
+
+func handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if !validSecret(requestSecret(r, r.PostFormValue("secret"))) {
+		notAuthorized(w)
+		return
+	}
+	slug := normalizeSlug(r.PostFormValue("slug"))
+	url := normalizeTarget(strings.TrimSpace(r.PostFormValue("url")))
+	if e := validateTarget(url); e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	if found, e := updateSlug(slug, url); e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	} else if !found {
+		http.NotFound(w, r)
+		return
+	}
+	writeShortened(w, r, submitResult{Slug: slug, Target: url})
+}
+
+// parseTTL accepts everything time.ParseDuration does, optionally prefixed with a number of days, such as 7d or 1d12h
+func parseTTL(ttl string) (time.Duration, error) {
+	var days time.Duration
+	if ix := strings.Index(ttl, "d"); ix != -1 {
+		n, e := strconv.Atoi(ttl[:ix])
+		if e != nil {
+			return 0, fmt.Errorf("invalid number of days in ttl: %q", ttl)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		ttl = ttl[ix+1:]
+		if ttl == "" {
+			return days, nil
+		}
+	}
+	d, e := time.ParseDuration(ttl)
+	if e != nil {
+		return 0, e
+	}
+	return days + d, nil
+}
+
+// expired needs to be called with at least the read lock on storage held
+func expired(slug string, now time.Time) bool {
+	expiry, ok := expiries[slug]
+	return ok && !now.Before(expiry)
+}
+
+// expireSlug removes the slug if it has expired, returning true if that was the case
+func expireSlug(slug string) bool {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	if _, ok := storage.Get(slug); !ok || !expired(slug, time.Now()) {
+		return false
+	}
+	removeSlug(slug)
+	persistRemoval(slug)
+	slog.Info("expired shortening", "slug", slug)
+	return true
+}
+
+// consumeUse counts a click on a slug with a use limit, removing the slug when that was its last use.
+// The click is counted here rather than by the caller, so that it can't be recorded for a slug that
+// is already gone. It returns false if the slug has been used up or removed concurrently, in which
+// case the redirect must not be served
+func consumeUse(slug string) bool {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	uses, ok := remainingUses[slug]
+	if !ok {
+		_, exists := storage.Get(slug)
+		if exists {
+			countClick(slug)
+		}
+		return exists
+	}
+	if uses <= 1 {
+		removeSlug(slug)
+		persistRemoval(slug)
+		slog.Info("used up shortening", "slug", slug)
+		return true
+	}
+	remainingUses[slug] = uses - 1
+	countClick(slug)
+	persistSlugs(slug)
+	return true
+}
+
+func sweepExpired() {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for slug := range expiries {
+		if _, ok := storage.Get(slug); ok && expired(slug, now) {
+			removeSlug(slug)
+			persistRemoval(slug)
+			removed++
+		}
+	}
+	if removed > 0 {
+		slog.Info("swept expired shortenings", "count", removed)
+	}
+}
+
+func sweepPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		sweepExpired()
+		syncStorage()
+	}
+}
+
+func countClick(slug string) {
+	clicksMutex.Lock()
+	clicks[slug]++
+	lastAccess[slug] = time.Now()
+	clicksMutex.Unlock()
+}
+
+type slugStats struct {
+	Slug      string     `json:"slug"`
+	URL       string     `json:"url"`
+	Clicks    uint64     `json:"clicks"`
+	Key       string     `json:"key,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Protected bool       `json:"protected,omitempty"`
+	Created   *time.Time `json:"created,omitempty"`
+	Accessed  *time.Time `json:"accessed,omitempty"`
+	IP        string     `json:"ip,omitempty"`
+	Wildcard  bool       `json:"wildcard,omitempty"`
+	Alias     bool       `json:"alias,omitempty"`
+	Note      string     `json:"note,omitempty"`
+	// Only set for rotating slugs
+	Targets []weightedTarget `json:"targets,omitempty"`
+	Rules   []uaRule         `json:"rules,omitempty"`
+	// Only set for slugs created with max-uses
+	RemainingUses *uint64 `json:"remaining_uses,omitempty"`
+}
+
+type summaryStats struct {
+	Slugs       int     `json:"slugs"`
+	Clicks      uint64  `json:"clicks"`
+	Utilization float64 `json:"utilization"`
+	Collisions  uint64  `json:"collisions"`
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request, slug string) {
+	if !validSecret(requestSecret(r, r.FormValue("secret"))) {
+		notAuthorized(w)
+		return
+	}
+
+	var result interface{}
+	storageMutex.RLock()
+	clicksMutex.Lock()
+	if slug == "" {
+		summary := summaryStats{Slugs: storage.Len(), Utilization: slugSpaceUtilization(), Collisions: slugCollisionsTotal.Load()}
+		for _, count := range clicks {
+			summary.Clicks += count
+		}
+		result = summary
+	} else if url, ok := storage.Get(slug); ok {
+		stats := slugStats{Slug: slug, URL: url, Clicks: clicks[slug], Key: creators[slug]}
+		if expiry, ok := expiries[slug]; ok {
+			stats.Expires = &expiry
+		}
+		stats.Protected = passwords[slug] != ""
+		if uses, ok := remainingUses[slug]; ok {
+			stats.RemainingUses = &uses
+		}
+		if created, ok := createdAt[slug]; ok {
+			stats.Created = &created
+		}
+		if accessed, ok := lastAccess[slug]; ok {
+			stats.Accessed = &accessed
+		}
+		stats.IP = createdFrom[slug]
+		stats.Wildcard = wildcards[slug]
+		stats.Alias = aliases[slug]
+		stats.Targets = rotations[slug]
+		stats.Rules = uaRules[slug]
+		stats.Note = notes[slug]
+		result = stats
+	}
+	clicksMutex.Unlock()
+	storageMutex.RUnlock()
+
+	if result == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// shorten returns the slug for the URL, creating it if the URL hasn't been shortened before, or always
+// creating a new one if targets aren't deduplicated. A requested slug is used if it's valid and free,
+// otherwise a new one is generated. It needs to be called with the write lock on storage held, and
+// leaves persisting the new slug, and counting it once it's persisted, to the caller. Explicitly requesting a reserved slug fails with
+// errReservedSlug, and one that is too short or too long with errSlugLength. Creating a slug when -max-slugs
+// are already stored fails with errStorageFull, and when the API key owns its quota of slugs with errQuotaExceeded.
+// With -strict-custom-slug, a requested slug that is taken or invalid fails with errSlugTaken or errInvalidSlug,
+// and with -reject-case-variants one differing only in case from an existing slug fails with errCaseVariant
+func shorten(url, slug string, meta linkMeta) (string, bool, error) {
+	slug, existing, e := resolveSlug(url, slug, meta, false)
+	if e != nil || existing {
+		return slug, false, e
+	}
+	storeSlug(slug, url, meta.restricted())
+	setMeta(slug, meta)
+	return slug, true, nil
+}
+
+// resolveSlug does everything shorten does except for storing the slug, returning the slug the URL would
+// get and whether that slug already exists. It needs to be called with the write lock on storage held,
+// since generating a slug can grow the generated length. For a dry run nothing at all is changed
+func resolveSlug(url, slug string, meta linkMeta, dryRun bool) (string, bool, error) {
+	slug = normalizeSlug(slug)
+	if reservedSlugs[slug] {
+		return "", false, errReservedSlug
+	}
+	if slug != "" && (len(slug) < *MinSlugLengthConfig || len(slug) > *MaxSlugLengthConfig) {
+		return "", false, errSlugLength
+	}
+	// In strict mode a requested slug is either used as it is or the submission fails
+	if slug != "" && *StrictCustomSlugConfig {
+		if invalidSlug(slug) {
+			return "", false, errInvalidSlug
+		}
+		if current, exists := storage.Get(slug); exists && current == url && !meta.restricted() && !restricted(slug) {
+			return slug, true, nil
+		} else if exists {
+			return "", false, errSlugTaken
+		}
+		if caseVariantTaken(slug) {
+			return "", false, errCaseVariant
+		}
+		if storageFull() {
+			return "", false, errStorageFull
+		}
+		if overQuota(meta.creator) {
+			return "", false, errQuotaExceeded
+		}
+		return slug, false, nil
+	}
+	// Protected, limited and wildcard links are never shared, so they don't take part in deduplication
+	if existingSlug, ok := storage.GetSlugForURL(url); ok && *DedupeTargetsConfig && !meta.restricted() && !restricted(existingSlug) {
+		return existingSlug, true, nil
+	}
+
+	if storageFull() {
+		return "", false, errStorageFull
+	}
+	if overQuota(meta.creator) {
+		return "", false, errQuotaExceeded
+	}
+	_, exists := storage.Get(slug)
+	if slug != "" && !exists && caseVariantTaken(slug) {
+		return "", false, errCaseVariant
+	}
+	if slug == "" || invalidSlug(slug) || exists {
+		var e error
+		if slug, e = genUniqueSlug(dryRun); e != nil {
+			return "", false, e
+		}
+	}
+	return slug, false, nil
+}
+
+// storageFull is true when no more slugs may be created. It needs to be called with at least the read lock
+// on storage held
+func storageFull() bool {
+	return *MaxSlugsConfig > 0 && storage.Len() >= *MaxSlugsConfig
+}
+
+// lookupSlug finds the slug for a request path, along with where it leads. For wildcard slugs the rest
+// of the path after the slug is added to the target. It needs to be called with at least the read lock
+// on storage held
+func lookupSlug(u *url.URL) (string, string, bool) {
+	slug := normalizeSlug(strings.TrimPrefix(u.Path, "/"))
+	if target, ok := storage.Get(slug); ok {
+		return slug, target, true
+	}
+	base, rest, found := strings.Cut(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	base = normalizeSlug(base)
+	if !found || !wildcards[base] {
+		return slug, "", false
+	}
+	target, ok := storage.Get(base)
+	if !ok {
+		return slug, "", false
+	}
+	if t, e := url.Parse(target); e == nil {
+		// JoinPath takes the rest as it was escaped in the request, and resolves any dot segments
+		target = t.JoinPath(rest).String()
+	}
+	return base, target, true
+}
+
+// redirectTarget is where a request for the slug with the given target goes, which differs from the
+// target when -passthrough-query is given. Fragments never reach the server, but browsers keep them
+// across the redirect anyway
+func redirectTarget(target string, r *http.Request) string {
+	if !*PassthroughQueryConfig || r.URL.RawQuery == "" {
+		return target
+	}
+	u, e := url.Parse(target)
+	if e != nil {
+		return target
+	}
+	query := u.Query()
+	for name, values := range r.URL.Query() {
+		// raw only tells the preview page apart from the redirect
+		if name == "raw" && *PreviewConfig {
+			continue
+		}
+		query[name] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redirect is http.Redirect, except that HEAD requests only get the status and Location, without the
+// Content-Type of the HTML body that isn't sent. Targets that can't be made absolute give a 500 instead
+// of a Location the browser would resolve against the shortener
+func redirect(w http.ResponseWriter, r *http.Request, target string, status int) {
+	location, e := absoluteLocation(target)
+	if e != nil {
+		slog.Error("refusing to redirect to invalid target", targetAttr("target", target), "error", e)
+		http.Error(w, "The link leads somewhere invalid", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != "HEAD" {
+		http.Redirect(w, r, location, status)
+		return
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(status)
+}
+
+// setCanonicalLink tells crawlers that the target is the page the short link stands for. A target that
+// can't be made absolute is left to redirect to fail on
+func setCanonicalLink(w http.ResponseWriter, target string) {
+	if location, e := absoluteLocation(target); e == nil {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"canonical\"", location))
+	}
+}
+
+// absoluteLocation makes sure a target is an absolute URL. Everything submitted is validated, but a hand
+// edited storage file can hold anything - a target without a scheme, like example.com/page, gets https
+func absoluteLocation(target string) (string, error) {
+	u, e := url.Parse(target)
+	if e != nil {
+		return "", e
+	}
+	if u.Scheme == "" {
+		if u, e = url.Parse("https://" + strings.TrimPrefix(target, "//")); e != nil {
+			return "", e
+		}
+	}
+	if u.Host == "" {
+		return "", errors.New("the target has no host")
+	}
+	return u.String(), nil
+}
+
+// permanentRedirectCache is how long browsers are told to keep a 301, which they would otherwise keep forever
+const permanentRedirectCache = 365 * 24 * time.Hour
+
+// setRedirectCache sets Cache-Control for a redirect. Links with a limited number of uses are never cached,
+// since every use has to reach the server, and links that expire are never cached past their expiry
+func setRedirectCache(w http.ResponseWriter, limited bool, expiry time.Time) {
+	maxAge := *RedirectCacheConfig
+	if maxAge < 0 {
+		maxAge = 0
+		if *RedirectStatusConfig == http.StatusMovedPermanently {
+			maxAge = permanentRedirectCache
+		}
+	}
+	if !expiry.IsZero() {
+		maxAge = min(maxAge, time.Until(expiry))
+	}
+
+	if limited {
+		w.Header().Set("Cache-Control", "no-store")
+	} else if maxAge <= 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(maxAge/time.Second)))
+	}
+}
+
+// serverName gives the scheme, host and base path that short URLs are built from for this request
+func serverName(r *http.Request) string {
+	return serverHost(r) + *BasePathConfig
+}
+
+func serverHost(r *http.Request) string {
+	if *TrustForwardedConfig {
+		proto := r.Header.Get("X-Forwarded-Proto")
+		host := r.Header.Get("X-Forwarded-Host")
+		if proto != "" && host != "" {
+			// Proxies appending to the headers put the original value first
+			proto = strings.TrimSpace(strings.Split(proto, ",")[0])
+			host = strings.TrimSpace(strings.Split(host, ",")[0])
+			if proto == "http" || proto == "https" {
+				return fmt.Sprintf("%s://%s", proto, host)
+			}
+		}
+	}
+	return *ServerNameConfig
+}
+
+type submitResult struct {
+	ShortURL string `json:"short_url"`
+	Slug     string `json:"slug"`
+	Target   string `json:"target"`
+	// Only set for dry runs, where Exists tells whether the slug is already in use for the URL
+	DryRun bool `json:"dry_run,omitempty"`
+	Exists bool `json:"exists,omitempty"`
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// The parsed -submit-response-template, or nil when plain text responses are just the short URL
+var submitTemplate *template.Template
+
+// parseSubmitTemplate parses the template and tries it out, since a misspelled field is only noticed
+// when the template is executed
+func parseSubmitTemplate(text string) (*template.Template, error) {
+	t, e := template.New("submit").Parse(text)
+	if e != nil {
+		return nil, e
+	}
+	if e := t.Execute(io.Discard, submitResult{}); e != nil {
+		return nil, e
+	}
+	return t, nil
+}
+
+// writeShortened responds with the short URL, as JSON if the client asks for it and as plain text otherwise
+func writeShortened(w http.ResponseWriter, r *http.Request, result submitResult) {
+	result.ShortURL = fmt.Sprintf("%s/%s", serverName(r), result.Slug)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	if submitTemplate == nil {
+		w.Write([]byte(result.ShortURL))
+		return
+	}
+	var response bytes.Buffer
+	if e := submitTemplate.Execute(&response, result); e != nil {
+		slog.Error("executing -submit-response-template", "slug", result.Slug, "error", e)
+		http.Error(w, "Could not write response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(response.Bytes())
+}
+
+// reloadOnSignal reads the seed and storage files again on SIGHUP, so that they can be edited while running
+func reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloadStorage()
+	}
+}
+
+// reloadStorage replaces everything in storage with what the files hold. Reading happens without the
+// lock, so requests are served from the old contents until they are swapped for the new ones in one go.
+// If either file can't be read, the old contents are kept. Click counts and access times are kept for
+// the slugs that are still there, since they are only written with the next rewrite, and never for
+// seeded slugs
+func reloadStorage() {
+	if *StorageBackendConfig != storageBackendFile || persistenceDisabled() {
+		slog.Warn("ignoring SIGHUP - reloading only works with a storage file")
+		return
+	}
+	seed := &storageContents{}
+	if *SeedFileConfig != "" {
+		var e error
+		if seed, e = parseStorageFile(*SeedFileConfig); e != nil {
+			slog.Error("not reloading, reading seed file failed", "file", *SeedFileConfig, "error", e)
+			return
+		}
+	}
+	contents, e := parseStorageFile(*FilenameStorageConfig)
+	if e != nil {
+		slog.Error("not reloading, reading storage file failed", "file", *FilenameStorageConfig, "error", e)
+		return
+	}
+
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	before := storage.Len()
+	if storageDirty {
+		slog.Warn("discarding changes that hadn't been written to the storage file yet")
+	}
+	clicksMutex.Lock()
+	counts, accessed := maps.Clone(clicks), maps.Clone(lastAccess)
+	clicksMutex.Unlock()
+	resetStorage()
+	seed.load(true)
+	contents.load(false)
+	keepClicks(counts, accessed)
+	checkConsistency()
+	storageDirty = false
+	slog.Info("reloaded storage", "file", *FilenameStorageConfig, "before", before, "after", storage.Len())
+}
+
+// keepClicks puts back click counts and access times from before a reload, for the slugs that are still in
+// storage. Counts only grow, so whichever is higher of the kept count and the one read is the latest, and
+// the same goes for access times. It needs to be called with the write lock on storage held
+func keepClicks(counts map[string]uint64, accessed map[string]time.Time) {
+	clicksMutex.Lock()
+	defer clicksMutex.Unlock()
+	for slug, count := range counts {
+		if _, ok := storage.Get(slug); ok {
+			clicks[slug] = max(clicks[slug], count)
+		}
+	}
+	for slug, at := range accessed {
+		if _, ok := storage.Get(slug); ok && at.After(lastAccess[slug]) {
+			lastAccess[slug] = at
+		}
+	}
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, drains active requests and writes the storage one last time
+func shutdownOnSignal(server *http.Server, done chan<- struct{}) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), *ShutdownTimeoutConfig)
+	defer cancel()
+	if e := server.Shutdown(ctx); e != nil {
+		slog.Error("shutting down server", "error", e)
+	}
+
+	// Until -load-in-background has finished loading, storage is incomplete and writing it out would lose links
+	storageMutex.Lock()
+	if !storageReady.Load() {
+		slog.Warn("stopping before storage was loaded, leaving it as it was")
+	} else if e := activeBackend.flush(); e != nil {
+		slog.Error("flushing storage", "error", e)
+	}
+	activeBackend.close()
+	count := storage.Len()
+	storageMutex.Unlock()
+	slog.Info("GoShort stopped... flushed URLs to storage", "urls", count)
+	close(done)
+}
+
+// slugNotFound responds to lookups of slugs that don't exist, forwarding to -notfound-redirect or using the
+// configured page if there is one
+func slugNotFound(w http.ResponseWriter, r *http.Request) {
+	if mistypedSlug(w, r) {
+		return
+	}
+	if target, ok := notFoundTarget(r.URL); ok {
+		redirect(w, r, target, http.StatusFound)
+		return
+	}
+	if *NotFoundPageConfig != "" {
+		if page, e := ioutil.ReadFile(*NotFoundPageConfig); e == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(page)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// The methods accepted on slug paths, where POST unlocks protected slugs
+var slugMethods = []string{"GET", "HEAD", "POST", "DELETE"}
+
+// endpointMethods gives the methods accepted on the API endpoint at the path, and false for slug paths
+func endpointMethods(path string) ([]string, bool) {
+	switch {
+	case path == "/submit" || path == "/bulk" || path == "/import" || path == "/alias" || path == "/update" || path == "/delete" || path == "/auth-check":
+		return []string{"POST"}, true
+	case path == *HealthPathConfig || path == *ReadyPathConfig || path == "/version":
+		return []string{"GET", "HEAD"}, true
+	case path == *MetricsPathConfig || path == "/export" || path == "/admin/list" || path == "/admin/usage" || path == "/admin/stale" || path == "/admin/search" || path == "/stats":
+		return []string{"GET"}, true
+	case strings.HasPrefix(path, "/qr/") || strings.HasPrefix(path, "/resolve/") || strings.HasPrefix(path, "/stats/"):
+		return []string{"GET"}, true
+	}
+	return nil, false
+}
+
+// limitBody limits posted bodies to -max-body-bytes and parses posted forms, answering 413 and returning
+// false when the body is larger. Bulk submissions and imports aren't forms, and are limited as they are read
+func limitBody(w http.ResponseWriter, r *http.Request, path string) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, *MaxBodyBytesConfig)
+	if path == "/bulk" || path == "/import" {
+		return true
+	}
+	return !bodyTooLarge(w, r.ParseForm())
+}
+
+// bodyTooLarge answers 413 when reading the body failed because of -max-body-bytes
+func bodyTooLarge(w http.ResponseWriter, e error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(e, &tooLarge) {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// allowHeader gives the Allow header for the methods, adding OPTIONS which every path answers
+func allowHeader(allow []string) string {
+	return strings.Join(append(slices.Clip(allow), "OPTIONS"), ", ")
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow []string) {
+	w.Header().Set("Allow", allowHeader(allow))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// handleOptions tells which methods the path accepts, without looking up slugs
+func handleOptions(w http.ResponseWriter, path string) {
+	allow, ok := endpointMethods(path)
+	if !ok {
+		allow = slugMethods
+	}
+	w.Header().Set("Allow", allowHeader(allow))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stripBasePath removes -base-path from the path of requests, so that everything else can treat the
+// service as owning the root. Requests outside the base path get a 404
+func stripBasePath(next http.Handler) http.Handler {
+	if *BasePathConfig == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, *BasePathConfig)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			http.NotFound(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		stripped := new(http.Request)
+		*stripped = *r
+		stripped.URL = new(url.URL)
+		*stripped.URL = *r.URL
+		stripped.URL.Path = rest
+		stripped.URL.RawPath = ""
+		if raw, ok := strings.CutPrefix(r.URL.RawPath, *BasePathConfig); ok && raw != "" {
+			stripped.URL.RawPath = raw
+		}
+		stripped.RequestURI = stripped.URL.RequestURI()
+		next.ServeHTTP(w, stripped)
+	})
+}
+
+// normalizeServerName checks that -server-name is something short URLs can be built from, and removes any
+// trailing slash so that the slug can be appended after a single slash
+func normalizeServerName(name string) (string, error) {
+	u, e := url.Parse(strings.TrimSpace(name))
+	if e != nil {
+		return "", e
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("it has to start with http:// or https://")
+	}
+	if u.Host == "" {
+		return "", errors.New("it has no host")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("it can't contain a user, query or fragment")
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+// normalizeBasePath gives the base path with a leading slash and without a trailing one
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// notFoundTarget gives where a request for a missing slug is forwarded to, with the path and query appended
+// to -notfound-redirect. Paths under the reserved endpoints are never forwarded
+func notFoundTarget(u *url.URL) (string, bool) {
+	if *NotFoundRedirectConfig == "" {
+		return "", false
+	}
+	first := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	if reservedSlugs[normalizeSlug(first)] {
+		return "", false
+	}
+	target := strings.TrimSuffix(*NotFoundRedirectConfig, "/") + u.EscapedPath()
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	return target, true
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	// Storage is locked while it's loaded in the background, and being alive doesn't depend on it
+	if !storageReady.Load() {
+		w.Write([]byte("OK - loading storage\n"))
+		return
+	}
+	storageMutex.RLock()
+	count := storage.Len()
+	storageMutex.RUnlock()
+	w.Write([]byte(fmt.Sprintf("OK - %d URLs\n", count)))
+}
+
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if !storageReady.Load() {
+		http.Error(w, "Storage not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	handleHealth(w, r)
+}
+
+// envName gives the environment variable that can be used instead of a flag, such as GOSHORT_STORAGE_FILE for -storage-file
+func envName(flagName string) string {
+	return "GOSHORT_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnvironment sets flags from the environment. It has to be called before flag.Parse, so that
+// flags given on the command line take precedence
+func applyEnvironment() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if e := f.Value.Set(value); e != nil {
+				fatal("invalid value in environment", "variable", envName(f.Name), "value", value, "error", e)
+			}
+		}
+	})
+}
+
+// configure checks the flags and prepares everything that depends on them, other than storage. Anything
+// wrong is fatal. It gives the TLS configuration, which is nil unless TLS is used
+func configure() *tls.Config {
+	if *StorageBackendConfig != storageBackendFile && *StorageBackendConfig != storageBackendSQLite {
+		fatal("invalid storage backend - must be either file or sqlite", "backend", *StorageBackendConfig)
+	}
+	if *StorageModeConfig != storageModeRewrite && *StorageModeConfig != storageModeAppend {
+		fatal("invalid storage mode - must be either rewrite or append", "mode", *StorageModeConfig)
+	}
+	if *NoPersistConfig && *StorageBackendConfig != storageBackendFile {
+		fatal("-no-persist can only be used with the file storage backend", "backend", *StorageBackendConfig)
+	}
+	if *StorageFormatConfig != storageFormatText && *StorageFormatConfig != storageFormatJSON {
+		fatal("invalid storage format - must be either text or json", "format", *StorageFormatConfig)
+	}
+	if *StorageFormatConfig == storageFormatJSON && *StorageModeConfig == storageModeAppend {
+		fatal("the json storage format can only be used with the rewrite storage mode")
+	}
+	if *RedirectStatusConfig != http.StatusMovedPermanently && *RedirectStatusConfig != http.StatusFound {
+		fatal("invalid redirect status - must be either 301 or 302", "status", *RedirectStatusConfig)
+	}
+	if *SlugStrategyConfig != slugStrategyRandom && *SlugStrategyConfig != slugStrategySequential {
+		fatal("invalid slug strategy - must be either random or sequential", "strategy", *SlugStrategyConfig)
+	}
+	if *SlugRandomConfig != slugRandomCrypto && *SlugRandomConfig != slugRandomMath {
+		fatal("invalid slug random source - must be either crypto or math", "source", *SlugRandomConfig)
+	}
+	if *MinSlugLengthConfig < 1 || *MinSlugLengthConfig > *MaxSlugLengthConfig {
+		fatal("invalid slug length bounds", "min", *MinSlugLengthConfig, "max", *MaxSlugLengthConfig)
+	}
+	if *SlugAlphabetConfig != "" {
+		if e := validateAlphabet(*SlugAlphabetConfig); e != nil {
+			fatal("invalid -slug-alphabet", "alphabet", *SlugAlphabetConfig, "error", e)
+		}
+	}
+	if *MaxStorageLineConfig <= storageLineOverhead {
+		fatal("-max-storage-line is too small", "max", *MaxStorageLineConfig, "min", storageLineOverhead+1)
+	}
+	if *StorageBackupsConfig < 0 {
+		fatal("-storage-backups can't be negative", "backups", *StorageBackupsConfig)
+	}
+	if *MaxURLLengthConfig < 1 {
+		fatal("-max-url-length has to be positive", "max", *MaxURLLengthConfig)
+	}
+	if *SlugChecksumConfig && *MaxSlugLengthConfig < 2 {
+		fatal("-slug-checksum needs a -max-slug-length of at least 2, to fit the check character")
+	}
+	if *SpaceConfig > *MaxSlugLengthConfig {
+		fatal("-space is larger than -max-slug-length", "space", *SpaceConfig, "max", *MaxSlugLengthConfig)
+	}
+	seedMathRand()
+	reserveSlugs()
+	if *SlugBlocklistConfig != "" {
+		if e := readBlocklist(); e != nil {
+			fatal("reading slug blocklist", "file", *SlugBlocklistConfig, "error", e)
+		}
+	}
+	if *RootRedirectConfig != "" {
+		if e := validateTarget(*RootRedirectConfig); e != nil {
+			fatal("invalid -root-redirect", "url", *RootRedirectConfig, "error", e)
+		}
+	}
+	*BasePathConfig = normalizeBasePath(*BasePathConfig)
+	if name, e := normalizeServerName(*ServerNameConfig); e != nil {
+		fatal("invalid -server-name", "name", *ServerNameConfig, "error", e)
+	} else {
+		*ServerNameConfig = name
+	}
+	if *NotFoundRedirectConfig != "" {
+		if e := validateTarget(*NotFoundRedirectConfig); e != nil {
+			fatal("invalid -notfound-redirect", "url", *NotFoundRedirectConfig, "error", e)
+		}
+	}
+	if *SubmitResponseTemplateConfig != "" {
+		var e error
+		if submitTemplate, e = parseSubmitTemplate(*SubmitResponseTemplateConfig); e != nil {
+			fatal("invalid -submit-response-template", "error", e)
+		}
+	}
+	if (*TLSCertConfig == "") != (*TLSKeyConfig == "") {
+		fatal("-tls-cert and -tls-key have to be given together")
+	}
+	var tlsConfig *tls.Config
+	if *TLSCertConfig != "" {
+		certificate, e := tls.LoadX509KeyPair(*TLSCertConfig, *TLSKeyConfig)
+		if e != nil {
+			fatal("loading TLS certificate", "cert", *TLSCertConfig, "key", *TLSKeyConfig, "error", e)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	}
+	if *KeysFileConfig != "" {
+		if e := readKeys(); e != nil {
+			fatal("reading keys file", "file", *KeysFileConfig, "error", e)
+		}
+		slog.Info("loaded API keys", "keys", len(apiKeys))
+	}
+	return tlsConfig
+}
+
+// newHandler gives the handler for every request the server answers. It serves from storage and persists
+// through activeBackend, like the rest of GoShort, so there is only one of each at a time and every handler
+// shares them. Nothing about it needs a server, so once those are set up it can just as well be exercised
+// with httptest.NewRecorder
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", dispatch)
+	return accessLog(stripBasePath(jsonErrors(mux)))
+}
+
+// dispatch routes a request, with the base path already removed, to whatever answers it
+func dispatch(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// Deferred first so it runs after any deferred unlock, and before the response goes out
+	defer syncStorage()
+	purl, _ := url.ParseRequestURI(r.RequestURI)
+	path := purl.Path
+
+	if apiPath(path) && setCORSHeaders(w, r) {
+		return
+	}
+	if r.Method == "OPTIONS" {
+		handleOptions(w, path)
+		return
+	}
+	if !storageReady.Load() && path != *HealthPathConfig && path != *ReadyPathConfig && path != "/version" {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Storage not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == "POST" && !limitBody(w, r, path) {
+		return
+	}
+
+	if r.Method == "POST" && path == "/submit" {
+		handleSubmit(w, r, start)
+	} else if r.Method == "POST" && path == "/bulk" {
+		handleBulk(w, r)
+	} else if r.Method == "POST" && path == "/import" {
+		handleImport(w, r)
+	} else if r.Method == "POST" && path == "/alias" {
+		handleAlias(w, r)
+	} else if r.Method == "POST" && path == "/update" {
+		handleUpdate(w, r)
+	} else if r.Method == "POST" && path == "/auth-check" {
+		handleUsage(w, r)
+	} else if r.Method == "POST" && path == "/delete" {
+		handleDelete(w, r, normalizeSlug(r.PostFormValue("slug")))
+	} else if allow, ok := endpointMethods(path); ok && !slices.Contains(allow, r.Method) {
+		methodNotAllowed(w, allow)
+	} else if r.Method == "DELETE" {
+		handleDelete(w, r, normalizeSlug(strings.TrimPrefix(path, "/")))
+	} else if (r.Method == "GET" || r.Method == "HEAD") && path == *HealthPathConfig {
+		handleHealth(w, r)
+	} else if (r.Method == "GET" || r.Method == "HEAD") && path == *ReadyPathConfig {
+		handleReady(w, r)
+	} else if (r.Method == "GET" || r.Method == "HEAD") && path == "/version" {
+		handleVersion(w, r)
+	} else if r.Method == "GET" && path == *MetricsPathConfig {
+		handleMetrics(w, r)
+	} else if r.Method == "GET" && path == "/export" {
+		handleExport(w, r)
+	} else if r.Method == "GET" && path == "/admin/list" {
+		handleList(w, r)
+	} else if r.Method == "GET" && path == "/admin/usage" {
+		handleUsage(w, r)
+	} else if r.Method == "GET" && path == "/admin/stale" {
+		handleStale(w, r)
+	} else if r.Method == "GET" && path == "/admin/search" {
+		handleSearch(w, r)
+	} else if r.Method == "GET" && strings.HasPrefix(path, "/resolve/") {
+		handleResolve(w, r, path)
+	} else if r.Method == "GET" && strings.HasPrefix(path, "/qr/") {
+		handleQR(w, r, normalizeSlug(strings.TrimPrefix(path, "/qr/")))
+	} else if r.Method == "GET" && (path == "/stats" || strings.HasPrefix(path, "/stats/")) {
+		handleStats(w, r, normalizeSlug(strings.TrimPrefix(strings.TrimPrefix(path, "/stats"), "/")))
+	} else if (r.Method == "GET" || r.Method == "HEAD") && path == "/" && *RootRedirectConfig != "" {
+		// Found rather than the configured status, so that the landing page can be changed later
+		redirect(w, r, *RootRedirectConfig, http.StatusFound)
+	} else if r.Method == "GET" || r.Method == "HEAD" {
+		storageMutex.RLock()
+		slug, url, ok := lookupSlug(purl)
+		url = chooseTarget(slug, url, r)
+		conditional := len(uaRules[slug]) > 0
+		protected := passwords[slug] != ""
+		limited := remainingUses[slug] > 0
+		expiry := expiries[slug]
+		gone := ok && expired(slug, time.Now())
+		storageMutex.RUnlock()
+		if gone {
+			expireSlug(slug)
+			http.Error(w, "Gone", http.StatusGone)
+		} else if ok && protected {
+			writePasswordForm(w, r, http.StatusOK)
+		} else if ok && previewRequested(r) {
+			writePreview(w, r, redirectTarget(url, r))
+		} else if ok && limited && r.Method != "HEAD" && !consumeUse(slug) {
+			slugNotFound(w, r)
+		} else if ok {
+			// Clicks on limited links are counted by consumeUse. HEAD, as sent by link checkers and unfurlers,
+			// doesn't use one of their uses up
+			if !limited {
+				countClick(slug)
+			}
+			redirectsTotal.Add(1)
+			setRedirectCache(w, limited, expiry)
+			if conditional {
+				w.Header().Add("Vary", "User-Agent")
+			}
+			target := redirectTarget(url, r)
+			if *CanonicalHeaderConfig {
+				setCanonicalLink(w, target)
+			}
+			redirect(w, r, target, *RedirectStatusConfig)
+			slog.Info("redirect", "slug", slug, targetAttr("target", url), "client", clientIP(r), "latency", time.Since(start))
+		} else {
+			slugNotFound(w, r)
+		}
+	} else if r.Method == "POST" {
+		handleUnlock(w, r)
+	} else {
+		methodNotAllowed(w, slugMethods)
+	}
+}
+
+// openStorage loads everything from the backend. Holding the lock while doing so keeps requests arriving
+// during a load in the background from seeing storage half loaded
+func openStorage() {
+	if e := checkStorageWritable(); e != nil {
+		fatal("storage file can't be written", "file", *FilenameStorageConfig, "error", e)
+	}
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	if e := loadBackend(); e != nil {
+		fatal("loading storage", "error", e)
+	}
+	checkConsistency()
+}
+
+// startStorage loads storage, marks it ready and starts everything that works on it in the background
+func startStorage() {
+	openStorage()
+	storageReady.Store(true)
+	if persistenceDisabled() && *StorageBackendConfig == storageBackendFile {
+		slog.Warn("persistence is disabled - nothing is written to disk, and all changes are lost when GoShort stops")
+	}
+	slog.Info("GoShort starting... loaded shortened URLs", "urls", storage.Len(), "version", version)
+
+	if *SubmitRateConfig > 0 || *UnlockRateConfig > 0 {
+		go pruneBucketsPeriodically(time.Minute)
+	}
+	if *SweepIntervalConfig > 0 {
+		go sweepPeriodically(*SweepIntervalConfig)
+	}
+	if *IdempotencyWindowConfig > 0 {
+		go pruneIdempotencyKeysPeriodically(time.Minute)
+	}
+	go reloadOnSignal()
+
+	if *StorageBackendConfig == storageBackendFile {
+		if *FlushIntervalConfig > 0 {
+			go flushPeriodically(*FlushIntervalConfig)
+		}
+		if *StorageModeConfig == storageModeAppend {
+			compactStorage()
+			if *CompactIntervalConfig > 0 {
+				go compactPeriodically(*CompactIntervalConfig)
+			}
+		}
+	}
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	applyEnvironment()
+	command := parseCommandLine()
+	if e := setupLogging(); e != nil {
+		fatal("configuring logging", "error", e)
+	}
+	tlsConfig := configure()
+	b, e := newBackend()
+	if e != nil {
+		fatal("opening storage", "error", e)
+	}
+	storage, activeBackend = newMapStorage(), b
+	if command != "" {
+		openStorage()
+		e := runCommand(command)
+		activeBackend.close()
+		if e != nil {
+			fatal("running "+command, "error", e)
+		}
+		return
+	}
+	handler := newHandler()
+	if *LoadInBackgroundConfig {
+		go startStorage()
+	} else {
+		startStorage()
+	}
+
+	listeners, e := listen()
+	if e != nil {
+		fatal("listening for connections", "error", e)
+	}
+	server := &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: *ReadHeaderTimeoutConfig,
+		ReadTimeout:       *ReadTimeoutConfig,
+		WriteTimeout:      *WriteTimeoutConfig,
+		IdleTimeout:       *IdleTimeoutConfig,
+	}
+	done := make(chan struct{})
+	go shutdownOnSignal(server, done)
+
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			if tlsConfig != nil {
+				// The certificate is already in TLSConfig
+				served <- server.ServeTLS(l, "", "")
+			} else {
+				served <- server.Serve(l)
+			}
+		}()
+	}
+	if e := <-served; e != http.ErrServerClosed {
+		fatal("serving connections", "error", e)
+	}
+	<-done
 }
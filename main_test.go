@@ -0,0 +1,502 @@
+package main
+
+import (
+	"flag"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testSecret = "test-secret"
+
+// newTestHandler gives a handler serving from fresh, empty storage that is only kept in memory, unless the
+// flags say otherwise. Flags are given as name and value pairs, and are set back once the test is done
+func newTestHandler(t *testing.T, flags ...string) http.Handler {
+	t.Helper()
+	setFlags(t, append([]string{"no-persist", "true", "secret", testSecret}, flags...)...)
+	storageMutex.Lock()
+	storage, activeBackend = newMapStorage(), fileBackend{}
+	resetStorage()
+	storageWriteError = nil
+	storageMutex.Unlock()
+	clear(submitLimiter.buckets)
+	clear(unlockLimiter.buckets)
+	reserveSlugs()
+	storageReady.Store(true)
+	return newHandler()
+}
+
+func setFlags(t *testing.T, flags ...string) {
+	t.Helper()
+	for ix := 0; ix+1 < len(flags); ix += 2 {
+		name, value := flags[ix], flags[ix+1]
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("unknown flag -%s", name)
+		}
+		old := f.Value.String()
+		if e := flag.Set(name, value); e != nil {
+			t.Fatalf("setting -%s to %q: %v", name, value, e)
+		}
+		t.Cleanup(func() { flag.Set(name, old) })
+	}
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func submit(h http.Handler, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/submit", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(h, r)
+}
+
+func TestSubmitAndRedirect(t *testing.T) {
+	h := newTestHandler(t)
+	w := submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/page"}, "slug": {"page"}})
+	if w.Code != http.StatusOK || w.Body.String() != "http://localhost/page" {
+		t.Fatalf("submit gave %d %q, expected 200 with the short URL", w.Code, w.Body.String())
+	}
+
+	w = serve(h, httptest.NewRequest("GET", "/page", nil))
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("redirect gave %d, expected 301", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://example.com/page" {
+		t.Errorf("redirect went to %q", location)
+	}
+}
+
+func TestSubmitDeduplicatesTargets(t *testing.T) {
+	h := newTestHandler(t)
+	form := url.Values{"secret": {testSecret}, "url": {"https://example.com/same"}}
+	first := submit(h, form).Body.String()
+	if second := submit(h, form).Body.String(); first != second {
+		t.Errorf("submitting the same URL twice gave %q and %q", first, second)
+	}
+}
+
+func TestSubmitUnauthorized(t *testing.T) {
+	h := newTestHandler(t)
+	w := submit(h, url.Values{"secret": {"wrong"}, "url": {"https://example.com/"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("submit with the wrong secret gave %d, expected 401", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without WWW-Authenticate")
+	}
+}
+
+func TestSubmitInvalidURL(t *testing.T) {
+	h := newTestHandler(t)
+	for _, target := range []string{"", "ftp://example.com/file", "https://", "https://example.com/a b"} {
+		if w := submit(h, url.Values{"secret": {testSecret}, "url": {target}}); w.Code != http.StatusBadRequest {
+			t.Errorf("submitting %q gave %d, expected 400", target, w.Code)
+		}
+	}
+}
+
+func TestSubmitStrictCustomSlug(t *testing.T) {
+	h := newTestHandler(t, "strict-custom-slug", "true")
+	submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/one"}, "slug": {"taken"}})
+	w := submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/two"}, "slug": {"taken"}})
+	if w.Code != http.StatusConflict {
+		t.Errorf("submitting a taken slug gave %d, expected 409", w.Code)
+	}
+}
+
+func TestUnknownSlug(t *testing.T) {
+	h := newTestHandler(t)
+	if w := serve(h, httptest.NewRequest("GET", "/missing", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("unknown slug gave %d, expected 404", w.Code)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	h := newTestHandler(t)
+	submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/gone"}, "slug": {"gone"}})
+
+	r := httptest.NewRequest("DELETE", "/gone", nil)
+	r.SetBasicAuth("", testSecret)
+	if w := serve(h, r); w.Code != http.StatusOK {
+		t.Fatalf("delete gave %d, expected 200", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/gone", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("deleted slug gave %d, expected 404", w.Code)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	h := newTestHandler(t)
+	w := serve(h, httptest.NewRequest("GET", "/submit", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /submit gave %d, expected 405", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "POST, OPTIONS" {
+		t.Errorf("Allow is %q", allow)
+	}
+}
+
+func TestHeadRedirect(t *testing.T) {
+	for _, status := range []string{"301", "302"} {
+		t.Run(status, func(t *testing.T) {
+			h := newTestHandler(t, "redirect-status", status)
+			submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/head"}, "slug": {"head"}})
+
+			get := serve(h, httptest.NewRequest("GET", "/head", nil))
+			head := serve(h, httptest.NewRequest("HEAD", "/head", nil))
+			if head.Code != get.Code || strconv.Itoa(head.Code) != status {
+				t.Errorf("HEAD gave %d and GET %d, expected %s for both", head.Code, get.Code, status)
+			}
+			if location := head.Header().Get("Location"); location != "https://example.com/head" || location != get.Header().Get("Location") {
+				t.Errorf("HEAD redirected to %q and GET to %q", location, get.Header().Get("Location"))
+			}
+			if head.Body.Len() != 0 {
+				t.Errorf("HEAD has a body of %d bytes", head.Body.Len())
+			}
+			if contentType := head.Header().Get("Content-Type"); contentType != "" {
+				t.Errorf("HEAD has Content-Type %q for a body that isn't sent", contentType)
+			}
+		})
+	}
+}
+
+func TestDryRunLeavesSequence(t *testing.T) {
+	h := newTestHandler(t, "slug-strategy", "sequential")
+	form := url.Values{"secret": {testSecret}, "url": {"https://example.com/dry"}, "dryrun": {"1"}}
+	first := submit(h, form).Body.String()
+	if second := submit(h, form).Body.String(); first != second {
+		t.Fatalf("dry runs gave %q and then %q", first, second)
+	}
+	form.Del("dryrun")
+	if created := submit(h, form).Body.String(); created != first {
+		t.Errorf("dry run gave %q, but the submission got %q", first, created)
+	}
+}
+
+func TestUnlockRateLimited(t *testing.T) {
+	h := newTestHandler(t, "unlock-burst", "2")
+	submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/locked"}, "slug": {"locked"}, "password": {"right"}})
+
+	for attempt, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("POST", "/locked", strings.NewReader("password=wrong"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if w := serve(h, r); w.Code != expected {
+			t.Errorf("attempt %d gave %d, expected %d", attempt+1, w.Code, expected)
+		}
+	}
+}
+
+func TestAliasAnswersLikeSubmit(t *testing.T) {
+	h := newTestHandler(t, "strict-custom-slug", "true", "min-slug-length", "2")
+	submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/first"}, "slug": {"first"}})
+
+	for _, slug := range []string{"first", "not~valid", "x", "submit"} {
+		submitted := submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/other"}, "slug": {slug}})
+		r := httptest.NewRequest("POST", "/alias", strings.NewReader(url.Values{"secret": {testSecret}, "url": {"https://example.com/first"}, "slug": {slug}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		aliased := serve(h, r)
+		if submitted.Code != aliased.Code || submitted.Body.String() != aliased.Body.String() {
+			t.Errorf("slug %q gave %d %q when submitting, but %d %q as an alias", slug, submitted.Code, submitted.Body.String(), aliased.Code, aliased.Body.String())
+		}
+	}
+}
+
+func TestSubmitCountsTooLongFields(t *testing.T) {
+	h := newTestHandler(t)
+	note := submitErrorCount(submitErrorInvalidNote)
+	submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/"}, "note": {strings.Repeat("n", maxNoteLength+1)}})
+	if submitErrorCount(submitErrorInvalidNote) != note+1 {
+		t.Error("a note that is too long wasn't counted")
+	}
+
+	key := submitErrorCount(submitErrorInvalidKey)
+	r := httptest.NewRequest("POST", "/submit", strings.NewReader(url.Values{"secret": {testSecret}, "url": {"https://example.com/"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Idempotency-Key", strings.Repeat("k", maxIdempotencyKeyLength+1))
+	if w := serve(h, r); w.Code != http.StatusBadRequest {
+		t.Fatalf("an Idempotency-Key that is too long gave %d, expected 400", w.Code)
+	}
+	if submitErrorCount(submitErrorInvalidKey) != key+1 {
+		t.Error("an Idempotency-Key that is too long wasn't counted")
+	}
+}
+
+func submitErrorCount(kind string) float64 {
+	return testutil.ToFloat64(submitErrorsTotal.WithLabelValues(kind))
+}
+
+func TestSubmitTooLongToStore(t *testing.T) {
+	h := newTestHandler(t, "max-storage-line", "2000")
+	long := "https://example.com/" + strings.Repeat("a", 900)
+	w := submit(h, url.Values{"secret": {testSecret}, "url": {long + "1", long + "2", long + "3"}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("rotating between targets too long to store together gave %d, expected 400", w.Code)
+	}
+	if w := submit(h, url.Values{"secret": {testSecret}, "url": {long}}); w.Code != http.StatusOK {
+		t.Errorf("a single target that fits gave %d", w.Code)
+	}
+}
+
+func TestBulkAndImportBodiesLimited(t *testing.T) {
+	h := newTestHandler(t, "max-body-bytes", "100")
+	body := `[{"url":"https://example.com/` + strings.Repeat("a", 100) + `"}]`
+	for _, path := range []string{"/bulk", "/import"} {
+		r := httptest.NewRequest("POST", path+"?secret="+testSecret, strings.NewReader(body))
+		if w := serve(h, r); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("posting %d bytes to %s gave %d, expected 413", len(body), path, w.Code)
+		}
+	}
+}
+
+func TestRestrictedLinksLeaveDeduplication(t *testing.T) {
+	for _, field := range []string{"password", "max-uses", "wildcard"} {
+		t.Run(field, func(t *testing.T) {
+			h := newTestHandler(t)
+			form := url.Values{"secret": {testSecret}, "url": {"https://example.com/shared"}}
+			plain := submit(h, form).Body.String()
+
+			restricted := url.Values{"secret": {testSecret}, "url": {"https://example.com/shared"}, field: {"1"}}
+			if own := submit(h, restricted).Body.String(); own == plain {
+				t.Fatalf("the %s link got the plain link %q", field, own)
+			}
+			if again := submit(h, form).Body.String(); again != plain {
+				t.Errorf("submitting the URL again gave %q, expected the plain link %q", again, plain)
+			}
+		})
+	}
+}
+
+func TestSubmitsShareRewrites(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "urls")
+	h := newTestHandler(t, "no-persist", "false", "storage-file", name, "flush-interval", "0")
+
+	var wg sync.WaitGroup
+	for ix := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/" + strconv.Itoa(ix)}})
+			if w.Code != http.StatusOK {
+				t.Errorf("submit %d gave %d", ix, w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, e := os.ReadFile(name)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if links := strings.Count(string(data), "\thttps://"); links != 20 {
+		t.Errorf("storage file has %d links once every submit has been answered, expected 20", links)
+	}
+}
+
+func TestFailedRewriteTakesSubmitBack(t *testing.T) {
+	// Renaming the written file over a directory fails
+	h := newTestHandler(t, "no-persist", "false", "storage-file", t.TempDir(), "flush-interval", "0")
+	w := submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/lost"}, "slug": {"lost"}})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("submit that couldn't be written gave %d, expected 500", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/lost", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("slug that couldn't be written gave %d, expected 404", w.Code)
+	}
+}
+
+func TestMistypedSlugSuggestions(t *testing.T) {
+	h := newTestHandler(t, "slug-checksum", "true", "notfound-redirect", "https://main.example.org")
+	slug := strings.TrimPrefix(submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/typo"}}).Body.String(), "http://localhost/")
+
+	for _, path := range []string{"/about", "/pricing"} {
+		w := serve(h, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "https://main.example.org"+path {
+			t.Errorf("%s gave %d to %q, expected the -notfound-redirect", path, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	mistyped := []rune(slug)
+	if mistyped[0] == 'a' {
+		mistyped[0] = 'b'
+	} else {
+		mistyped[0] = 'a'
+	}
+	w := serve(h, httptest.NewRequest("GET", "/"+string(mistyped), nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), slug) {
+		t.Errorf("mistyped %s gave %d %q, expected 404 suggesting %s", string(mistyped), w.Code, w.Body.String(), slug)
+	}
+}
+
+func TestHeadKeepsLimitedUses(t *testing.T) {
+	h := newTestHandler(t)
+	submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/once"}, "slug": {"once"}, "max-uses": {"1"}})
+
+	if w := serve(h, httptest.NewRequest("HEAD", "/once", nil)); w.Code != http.StatusMovedPermanently {
+		t.Fatalf("HEAD gave %d, expected 301", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/once", nil)); w.Code != http.StatusMovedPermanently {
+		t.Fatalf("GET after HEAD gave %d, expected 301", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/once", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("GET after the only use gave %d, expected 404", w.Code)
+	}
+}
+
+func TestPreviewKeepsWildcardPath(t *testing.T) {
+	h := newTestHandler(t, "preview", "true", "base-path", "/s")
+	form := url.Values{"secret": {testSecret}, "url": {"https://example.com/docs"}, "slug": {"docs"}, "wildcard": {"1"}}
+	r := httptest.NewRequest("POST", "/s/submit", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	serve(h, r)
+
+	w := serve(h, httptest.NewRequest("GET", "/s/docs/a%20b/c?x=1", nil))
+	if !strings.Contains(w.Body.String(), `href="/s/docs/a%20b/c?raw=1&amp;x=1"`) {
+		t.Errorf("preview doesn't continue to the same path:\n%s", w.Body.String())
+	}
+}
+
+func TestUpdateTooLongToStore(t *testing.T) {
+	h := newTestHandler(t, "max-storage-line", "2000")
+	long := "https://example.com/" + strings.Repeat("a", 900)
+	w := submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/short"}, "slug": {"rules"}, "ua-match": {"bot", "crawler"}, "ua-url": {long, long}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("submit gave %d %q", w.Code, w.Body.String())
+	}
+
+	r := httptest.NewRequest("POST", "/update", strings.NewReader(url.Values{"secret": {testSecret}, "slug": {"rules"}, "url": {long + "/more"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serve(h, r); w.Code != http.StatusBadRequest {
+		t.Fatalf("update too long to store with the rules gave %d, expected 400", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/rules", nil)); w.Header().Get("Location") != "https://example.com/short" {
+		t.Errorf("refused update still changed the target to %q", w.Header().Get("Location"))
+	}
+}
+
+func TestMetricsFormat(t *testing.T) {
+	h := newTestHandler(t)
+	submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/one"}})
+	submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/two"}})
+	submit(h, url.Values{"secret": {"wrong"}, "url": {"https://example.com/three"}})
+
+	expected := `# HELP goshort_slugs Current number of shortened URLs.
+# TYPE goshort_slugs gauge
+goshort_slugs 2
+`
+	if e := testutil.GatherAndCompare(metrics, strings.NewReader(expected), "goshort_slugs"); e != nil {
+		t.Error(e)
+	}
+
+	w := serve(h, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("metrics gave %d with %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE goshort_redirects_total counter",
+		"# TYPE goshort_slugs_created_total counter",
+		"# TYPE goshort_submit_errors_total counter",
+		"# TYPE goshort_slug_collisions_total counter",
+		"# TYPE goshort_slug_space_utilization gauge",
+		`goshort_submit_errors_total{type="unauthorized"} `,
+		"goshort_slugs 2\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics are missing %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestPasswordProtectedLink(t *testing.T) {
+	h := newTestHandler(t)
+	if w := submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/secret"}, "slug": {"locked"}, "password": {"hunter2"}}); w.Code != http.StatusOK {
+		t.Fatalf("submit gave %d: %s", w.Code, w.Body)
+	}
+	storageMutex.RLock()
+	hash := passwords["locked"]
+	storageMutex.RUnlock()
+	if cost, e := bcrypt.Cost([]byte(hash)); e != nil || cost != passwordCost {
+		t.Errorf("the password was stored as %q, not as a bcrypt hash with cost %d", hash, passwordCost)
+	}
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/locked", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(h, r)
+	}
+	if w := unlock("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("a wrong password gave %d, expected 401", w.Code)
+	}
+	if w := unlock("hunter2"); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "https://example.com/secret" {
+		t.Errorf("the right password gave %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w := submit(h, url.Values{"secret": {testSecret}, "url": {"https://example.com/long"}, "password": {strings.Repeat("p", maxPasswordLength+1)}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a password longer than bcrypt takes gave %d, expected 400", w.Code)
+	}
+}
+
+func TestParseStorageLine(t *testing.T) {
+	none := map[string]string{}
+	for _, c := range []struct {
+		line      string
+		slug, url string
+		fields    map[string]string
+		ok        bool
+	}{
+		{"abc https://example.com/", "abc", "https://example.com/", none, true},
+		{"abc https://example.com/\tkey=k1\tclicks=3", "abc", "https://example.com/", map[string]string{"key": "k1", "clicks": "3"}, true},
+		{"abc https://example.com/?a=b", "abc", "https://example.com/?a=b", none, true},
+		{"abc https://example.com/?a=b\tclicks=3", "abc", "https://example.com/?a=b", map[string]string{"clicks": "3"}, true},
+		{"abc\thttps://example.com/", "abc", "https://example.com/", none, true},
+		{"abc\thttps://example.com/?a=b&c=d", "abc", "https://example.com/?a=b&c=d", none, true},
+		{"abc\thttps://example.com/?a=b\tkey=k1\tnote=x%3Dy", "abc", "https://example.com/?a=b", map[string]string{"key": "k1", "note": "x%3Dy"}, true},
+		{"abc\thttps://example.com/\tbroken", "abc", "https://example.com/", none, true},
+		{"abc", "", "", nil, false},
+		{"abc ", "", "", nil, false},
+		{" https://example.com/", "", "", nil, false},
+		{"abc\t", "", "", nil, false},
+		{"\thttps://example.com/", "", "", nil, false},
+		{"\thttps://example.com/\tkey=k1", "", "", nil, false},
+		{" https://example.com/\tkey=k1", "", "", nil, false},
+	} {
+		slug, url, fields, ok := parseStorageLine(c.line)
+		if slug != c.slug || url != c.url || ok != c.ok || !maps.Equal(fields, c.fields) {
+			t.Errorf("parseStorageLine(%q) = %q, %q, %v, %v - expected %q, %q, %v, %v", c.line, slug, url, fields, ok, c.slug, c.url, c.fields, c.ok)
+		}
+	}
+}
+
+func TestLoggedURI(t *testing.T) {
+	for _, base := range []string{"", "/s"} {
+		setFlags(t, "log-targets", "false", "base-path", base)
+		for path, expected := range map[string]string{
+			"/abc":                   "/abc",
+			"/abc/more/of/the/path":  "/abc/REDACTED",
+			"/abc?token=x":           "/abc?token=REDACTED",
+			"/submit?secret=x":       "/submit?secret=REDACTED",
+			"/stats/abc":             "/stats/abc",
+			"/admin/list?creator=me": "/admin/list?creator=REDACTED",
+		} {
+			u, _ := url.Parse(base + path)
+			if logged := loggedURI(u); logged != base+expected {
+				t.Errorf("with -base-path %q, %s was logged as %s, expected %s", base, base+path, logged, base+expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are exposed with the Prometheus client library. None of them are labeled by slug, to keep
+// the cardinality bounded no matter how many URLs are shortened
+
+const (
+	submitErrorUnauthorized    = "unauthorized"
+	submitErrorInvalidURL      = "invalid_url"
+	submitErrorInvalidTTL      = "invalid_ttl"
+	submitErrorSlugsExhausted  = "slugs_exhausted"
+	submitErrorRateLimited     = "rate_limited"
+	submitErrorReservedSlug    = "reserved_slug"
+	submitErrorInvalidSlug     = "invalid_slug"
+	submitErrorInvalidMaxUses  = "invalid_max_uses"
+	submitErrorStorageFull     = "storage_full"
+	submitErrorQuotaExceeded   = "quota_exceeded"
+	submitErrorSlugTaken       = "slug_taken"
+	submitErrorNotStored       = "not_stored"
+	submitErrorInvalidNote     = "invalid_note"
+	submitErrorInvalidPassword = "invalid_password"
+	submitErrorInvalidKey      = "invalid_idempotency_key"
+)
+
+// The counters that are also read outside of /metrics are kept as atomics, and exported through
+// counter funcs below
+var redirectsTotal atomic.Uint64
+var slugsCreatedTotal atomic.Uint64
+
+// Generated slugs that were free, and generated slugs that had to be thrown away because they weren't
+var slugsGeneratedTotal atomic.Uint64
+var slugCollisionsTotal atomic.Uint64
+
+var submitErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "goshort_submit_errors_total",
+	Help: "Total number of rejected submissions, by type of error.",
+}, []string{"type"})
+
+// metrics is the registry served on -metrics-path. It is separate from the default registry, so that only
+// goshort's own metrics are exposed
+var metrics = prometheus.NewRegistry()
+
+func init() {
+	metrics.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "goshort_redirects_total",
+			Help: "Total number of redirects served.",
+		}, func() float64 { return float64(redirectsTotal.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "goshort_slugs_created_total",
+			Help: "Total number of slugs created.",
+		}, func() float64 { return float64(slugsCreatedTotal.Load()) }),
+		submitErrorsTotal,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "goshort_slug_collisions_total",
+			Help: "Total number of generated slugs that were already taken.",
+		}, func() float64 { return float64(slugCollisionsTotal.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "goshort_slugs",
+			Help: "Current number of shortened URLs.",
+		}, func() float64 {
+			storageMutex.RLock()
+			defer storageMutex.RUnlock()
+			return float64(storage.Len())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "goshort_slug_space_utilization",
+			Help: "Share of the possible slugs of the generated length that are in use.",
+		}, func() float64 {
+			storageMutex.RLock()
+			defer storageMutex.RUnlock()
+			return slugSpaceUtilization()
+		}),
+	)
+}
+
+func countSubmitError(kind string) {
+	submitErrorsTotal.WithLabelValues(kind).Inc()
+}
+
+var metricsHandler = promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsHandler.ServeHTTP(w, r)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are stored as bcrypt hashes. Bcrypt only looks at the first 72 bytes, so longer
+// passwords are refused rather than silently cut short
+const (
+	passwordCost      = bcrypt.DefaultCost
+	maxPasswordLength = 72
+)
+
+var errPasswordTooLong = fmt.Errorf("password can't be longer than %d bytes", maxPasswordLength)
+
+// The password hash of each protected slug
+var passwords map[string]string
+
+func init() {
+	passwords = make(map[string]string)
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) > maxPasswordLength {
+		return "", errPasswordTooLong
+	}
+	hash, e := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(hash), e
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+var passwordForm = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Password required</title></head>
+<body>
+<form method="POST" action="{{.Action}}">
+<p>This link is protected. Enter the password to continue.</p>
+{{if .Wrong}}<p>Wrong password.</p>{{end}}
+<input type="password" name="password" autofocus>
+<input type="submit" value="Continue">
+</form>
+</body>
+</html>
+`))
+
+// writePasswordForm shows the form, which posts back to the path it was requested for
+func writePasswordForm(w http.ResponseWriter, r *http.Request, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	passwordForm.Execute(w, struct {
+		Action string
+		Wrong  bool
+	}{*BasePathConfig + r.URL.EscapedPath(), status == http.StatusUnauthorized})
+}
+
+// handleUnlock redirects to the target of a protected slug when the posted password is correct
+func handleUnlock(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	storageMutex.RLock()
+	slug, url, ok := lookupSlug(r.URL)
+	url = chooseTarget(slug, url, r)
+	hash := passwords[slug]
+	limited := remainingUses[slug] > 0
+	gone := ok && expired(slug, time.Now())
+	storageMutex.RUnlock()
+
+	if !ok || hash == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if gone {
+		expireSlug(slug)
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+	// Checked before the password is, so that guessing can't keep the CPU busy hashing
+	if !allowUnlockFrom(r) {
+		slog.Warn("too many password attempts", "slug", slug, "client", clientIP(r))
+		http.Error(w, "Too many password attempts", http.StatusTooManyRequests)
+		return
+	}
+	if !checkPassword(hash, r.PostFormValue("password")) {
+		slog.Warn("wrong password", "slug", slug, "client", clientIP(r))
+		writePasswordForm(w, r, http.StatusUnauthorized)
+		return
+	}
+	if limited && !consumeUse(slug) {
+		http.NotFound(w, r)
+		return
+	} else if !limited {
+		countClick(slug)
+	}
+	redirectsTotal.Add(1)
+	// See Other makes the browser follow up with a GET, whatever the configured redirect status
+	redirect(w, r, url, http.StatusSeeOther)
+	slog.Info("redirect", "slug", slug, targetAttr("target", url), "client", clientIP(r), "latency", time.Since(start))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Leaving for {{.URL}}</title></head>
+<body>
+<p>This link goes to:</p>
+<p><code>{{.URL}}</code></p>
+<p><a href="{{.Continue}}">Continue</a></p>
+</body>
+</html>
+`))
+
+// previewRequested is true when the preview page should be shown instead of redirecting right away
+func previewRequested(r *http.Request) bool {
+	return *PreviewConfig && r.URL.Query().Get("raw") != "1"
+}
+
+// writePreview shows where the slug leads. The click is only counted once the user continues,
+// through the raw link back to the same path, which keeps the rest of the path for wildcard slugs
+// and the rest of the query for -passthrough-query
+func writePreview(w http.ResponseWriter, r *http.Request, target string) {
+	query := r.URL.Query()
+	query.Set("raw", "1")
+	continueURL := *BasePathConfig + r.URL.EscapedPath() + "?" + query.Encode()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	previewPage.Execute(w, struct {
+		URL      string
+		Continue string
+	}{target, continueURL})
+}
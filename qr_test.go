@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/common/reedsolomon"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/makiuchi-d/gozxing/qrcode/decoder"
+)
+
+// The most bytes that fit in each version, at error correction level M in byte mode
+var qrCapacities = []int{1: 14, 2: 26, 3: 42, 4: 62, 5: 84, 6: 106, 7: 122, 8: 152, 9: 180, 10: 213}
+
+func TestQRRoundTrip(t *testing.T) {
+	for version := 1; version < len(qrCapacities); version++ {
+		for _, length := range []int{qrCapacities[version-1] + 1, qrCapacities[version]} {
+			data := strings.Repeat("x", length)
+			modules, e := encodeQR([]byte(data))
+			if e != nil {
+				t.Fatalf("encoding %d bytes: %v", length, e)
+			}
+			if size := 17 + 4*version; len(modules) != size {
+				t.Errorf("%d bytes gave a code of %d modules, expected version %d with %d", length, len(modules), version, size)
+			}
+
+			result, e := decoder.NewDecoder().DecodeBoolMapWithoutHint(modules)
+			if e != nil {
+				t.Fatalf("decoding the modules for %d bytes: %v", length, e)
+			}
+			if result.GetText() != data || result.GetECLevel() != "M" {
+				t.Errorf("%d bytes decoded as %q at level %s", length, result.GetText(), result.GetECLevel())
+			}
+			checkErrorCorrection(t, modules, length)
+			if meta, ok := result.GetOther().(*decoder.QRCodeDecoderMetaData); ok && meta.IsMirrored() {
+				t.Errorf("%d bytes only decoded when mirrored", length)
+			}
+
+			// And the image has to scan like any other QR code
+			bitmap, _ := gozxing.NewBinaryBitmapFromImage(qrImage(modules, defaultQRSize))
+			scanned, e := qrcode.NewQRCodeReader().Decode(bitmap, map[gozxing.DecodeHintType]interface{}{gozxing.DecodeHintType_PURE_BARCODE: true})
+			if e != nil {
+				t.Fatalf("scanning the image for %d bytes: %v", length, e)
+			}
+			if scanned.GetText() != data {
+				t.Errorf("the image for %d bytes scanned as %q", length, scanned.GetText())
+			}
+		}
+	}
+}
+
+// checkErrorCorrection makes sure that every block read from the modules carries exactly the error
+// correction codewords for its data. Decoding alone would pass even with a few of them wrong, since the
+// decoder corrects them like any other damage
+func checkErrorCorrection(t *testing.T, modules [][]bool, length int) {
+	t.Helper()
+	bits, e := gozxing.ParseBoolMapToBitMatrix(modules)
+	if e != nil {
+		t.Fatal(e)
+	}
+	parser, e := decoder.NewBitMatrixParser(bits)
+	if e != nil {
+		t.Fatal(e)
+	}
+	version, e := parser.ReadVersion()
+	if e != nil {
+		t.Fatal(e)
+	}
+	format, e := parser.ReadFormatInformation()
+	if e != nil {
+		t.Fatal(e)
+	}
+	codewords, e := parser.ReadCodewords()
+	if e != nil {
+		t.Fatal(e)
+	}
+	blocks, e := decoder.DataBlock_GetDataBlocks(codewords, version, format.GetErrorCorrectionLevel())
+	if e != nil {
+		t.Fatal(e)
+	}
+	encoder := reedsolomon.NewReedSolomonEncoder(reedsolomon.GenericGF_QR_CODE_FIELD_256)
+	for ix, block := range blocks {
+		read := block.GetCodewords()
+		expected := make([]int, len(read))
+		for i := 0; i < block.GetNumDataCodewords(); i++ {
+			expected[i] = int(read[i])
+		}
+		if e := encoder.Encode(expected, len(read)-block.GetNumDataCodewords()); e != nil {
+			t.Fatal(e)
+		}
+		for i := range read {
+			if int(read[i]) != expected[i] {
+				t.Errorf("block %d of the code for %d bytes has codeword %d as %d, expected %d", ix, length, i, read[i], expected[i])
+				break
+			}
+		}
+	}
+}
+
+func TestQRTooLong(t *testing.T) {
+	if _, e := encodeQR(make([]byte, qrCapacities[len(qrCapacities)-1]+1)); e != errQRTooLong {
+		t.Errorf("encoding more than fits in version %d gave %v, expected errQRTooLong", len(qrCapacities)-1, e)
+	}
+}
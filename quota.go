@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Each API key may own at most its quota of slugs, given after the key in the keys file or by -key-quota.
+// Usage is the number of stored slugs created with the key, so it survives restarts along with the slugs
+// and deleting a slug frees up room for another
+
+var errQuotaExceeded = errors.New("the API key has used up its quota")
+
+// The quotas given in the keys file, by key identity
+var keyQuotas = make(map[string]int)
+
+// The number of slugs owned by each key identity. Protected by storageMutex, and kept in step with
+// creators by setMeta and removeSlug
+var keyUsage = make(map[string]int)
+
+func keyQuota(id string) int {
+	if quota, ok := keyQuotas[id]; ok {
+		return quota
+	}
+	return *KeyQuotaConfig
+}
+
+// overQuota is true when the key may not create any more slugs. It needs to be called with at least the
+// read lock on storage held
+func overQuota(id string) bool {
+	if id == "" {
+		return false
+	}
+	quota := keyQuota(id)
+	return quota > 0 && keyUsage[id] >= quota
+}
+
+// recountKeyUsage needs to be called with the write lock on storage held
+func recountKeyUsage() {
+	clear(keyUsage)
+	for _, creator := range creators {
+		keyUsage[creator]++
+	}
+}
+
+type usageResult struct {
+	Key   string `json:"key,omitempty"`
+	Slugs int    `json:"slugs"`
+	// Zero when there is no quota
+	Quota int `json:"quota"`
+}
+
+// handleUsage tells the caller how many slugs its key owns, and how many it may own. It also answers
+// POST /auth-check, which clients use to check their credentials without creating anything
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	id, authorized := authenticate(requestSecret(r, r.FormValue("secret")))
+	if !authorized {
+		notAuthorized(w)
+		return
+	}
+
+	result := usageResult{Key: id}
+	storageMutex.RLock()
+	if id == "" {
+		// Without a keys file, the secret owns everything
+		result.Slugs = storage.Len()
+	} else {
+		result.Slugs = keyUsage[id]
+		result.Quota = keyQuota(id)
+	}
+	storageMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Requests are rate limited using one token bucket per client. It holds at most burst tokens and refills
+// at rate tokens per second, with every request using up one token
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type limiter struct {
+	rate    *float64
+	burst   *int
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+func newLimiter(rate *float64, burst *int) *limiter {
+	return &limiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// Submissions are limited by -submit-rate and -submit-burst. Password attempts on protected slugs are
+// limited by -unlock-rate and -unlock-burst, since every attempt costs a deliberately slow hash
+var submitLimiter = newLimiter(SubmitRateConfig, SubmitBurstConfig)
+var unlockLimiter = newLimiter(UnlockRateConfig, UnlockBurstConfig)
+
+func (l *limiter) allow(client string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(*l.burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * *l.rate
+	if max := float64(*l.burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowSubmitFrom applies the rate limit to a submission. Clients using an API key are limited per key,
+// everyone else per address
+func allowSubmitFrom(r *http.Request, creator string) bool {
+	if *SubmitRateConfig <= 0 {
+		return true
+	}
+	client := clientIP(r)
+	if creator != "" {
+		client = "key:" + creator
+	}
+	return submitLimiter.allow(client, time.Now())
+}
+
+// allowUnlockFrom applies the rate limit to a password attempt, per address
+func allowUnlockFrom(r *http.Request) bool {
+	if *UnlockRateConfig <= 0 {
+		return true
+	}
+	return unlockLimiter.allow(clientIP(r), time.Now())
+}
+
+// prune forgets about clients whose buckets have filled up again, since a new bucket is equivalent
+// to a full one
+func (l *limiter) prune(now time.Time) {
+	if *l.rate <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	full := time.Duration(float64(*l.burst) / *l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func pruneBucketsPeriodically(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		submitLimiter.prune(now)
+		unlockLimiter.prune(now)
+	}
+}
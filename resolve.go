@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type resolveResult struct {
+	Slug string `json:"slug"`
+	// Left out for protected slugs, unless the secret is given
+	URL       string     `json:"url,omitempty"`
+	Clicks    uint64     `json:"clicks"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Protected bool       `json:"protected,omitempty"`
+	// Left out for protected slugs like the URL
+	Note string `json:"note,omitempty"`
+}
+
+// handleResolve tells where the path after /resolve leads without redirecting, so no click is counted and
+// no use is consumed. Wildcard slugs resolve with the rest of the path added, just like when redirecting
+func handleResolve(w http.ResponseWriter, r *http.Request, path string) {
+	authorized := validSecret(requestSecret(r, r.FormValue("secret")))
+	if *ResolveRequireSecretConfig && !authorized {
+		notAuthorized(w)
+		return
+	}
+
+	storageMutex.RLock()
+	slug, target, ok := lookupSlug(&url.URL{Path: strings.TrimPrefix(path, "/resolve")})
+	result := resolveResult{Slug: slug, URL: target, Protected: passwords[slug] != "", Note: notes[slug]}
+	if expiry, ok := expiries[slug]; ok {
+		result.Expires = &expiry
+	}
+	gone := ok && expired(slug, time.Now())
+	storageMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if gone {
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+	if result.Protected && !authorized {
+		result.URL = ""
+		result.Note = ""
+	}
+	clicksMutex.Lock()
+	result.Clicks = clicks[slug]
+	clicksMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
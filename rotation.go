@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A rotating slug redirects to one of several targets, picked at random in proportion to their weights on
+// every redirect. The first target is the URL kept in storage, which is what the slug resolves to everywhere
+// else, such as for deduplication and /stats
+
+const maxRotationTargets = 100
+const maxTargetWeight = 1000000
+
+type weightedTarget struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// The targets of each rotating slug. Protected by storageMutex
+var rotations = make(map[string][]weightedTarget)
+
+// parseRotation reads targets posted as repeated url fields, optionally with a weight field for each url in
+// the same order. A single url means the slug doesn't rotate, and gives no targets
+func parseRotation(r *http.Request) ([]weightedTarget, error) {
+	urls := r.PostForm["url"]
+	if len(urls) < 2 {
+		return nil, nil
+	}
+	if len(urls) > maxRotationTargets {
+		return nil, fmt.Errorf("too many urls - a slug can rotate between at most %d", maxRotationTargets)
+	}
+	weights := r.PostForm["weight"]
+	if len(weights) > 0 && len(weights) != len(urls) {
+		return nil, errors.New("give a weight for every url, or for none of them")
+	}
+
+	targets := make([]weightedTarget, 0, len(urls))
+	for ix, raw := range urls {
+		url := normalizeTarget(strings.TrimSpace(raw))
+		if e := validateTarget(url); e != nil {
+			return nil, fmt.Errorf("url %d: %v", ix+1, e)
+		}
+		weight := 1
+		if len(weights) > 0 {
+			var e error
+			if weight, e = strconv.Atoi(weights[ix]); e != nil || weight < 1 || weight > maxTargetWeight {
+				return nil, fmt.Errorf("invalid weight %q - must be between 1 and %d", weights[ix], maxTargetWeight)
+			}
+		}
+		targets = append(targets, weightedTarget{URL: url, Weight: weight})
+	}
+	return targets, nil
+}
+
+// encodeRotation gives the targets as stored, weight:url pairs separated by spaces. Weights never contain
+// a colon, and URLs never contain whitespace
+func encodeRotation(targets []weightedTarget) string {
+	pairs := make([]string, len(targets))
+	for ix, target := range targets {
+		pairs[ix] = fmt.Sprintf("%d:%s", target.Weight, target.URL)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func decodeRotation(value string) []weightedTarget {
+	var targets []weightedTarget
+	for _, pair := range strings.Fields(value) {
+		raw, url, ok := strings.Cut(pair, ":")
+		weight, e := strconv.Atoi(raw)
+		if ok && e == nil && weight > 0 {
+			targets = append(targets, weightedTarget{URL: url, Weight: weight})
+		}
+	}
+	return targets
+}
+
+// pickTarget chooses where a redirect for the slug goes, which is the target itself unless the slug rotates.
+// It needs to be called with at least the read lock on storage held
+func pickTarget(slug, target string) string {
+	targets := rotations[slug]
+	total := 0
+	for _, candidate := range targets {
+		total += candidate.Weight
+	}
+	if total == 0 {
+		return target
+	}
+	n := mrand.Intn(total)
+	for _, candidate := range targets {
+		if n < candidate.Weight {
+			return candidate.URL
+		}
+		n -= candidate.Weight
+	}
+	return target
+}
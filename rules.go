@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A slug can have rules sending some clients somewhere else than its own target, matched on the User-Agent.
+// That's mostly for app download links, with iphone|ipad going to the App Store and android to Play. Rules
+// are checked in order, and a client that matches none of them gets the usual target
+
+const maxUARules = 20
+
+type uaRule struct {
+	// Match is one or more alternatives separated by |, each matched case insensitively anywhere in the
+	// User-Agent
+	Match string `json:"match"`
+	URL   string `json:"url"`
+}
+
+// The rules of each slug that has any. Protected by storageMutex
+var uaRules = make(map[string][]uaRule)
+
+func (rule uaRule) matches(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, alternative := range strings.Split(rule.Match, "|") {
+		if alternative = strings.ToLower(strings.TrimSpace(alternative)); alternative != "" && strings.Contains(userAgent, alternative) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUARules reads rules posted as repeated ua-match fields, with a ua-url field for each of them in
+// the same order
+func parseUARules(r *http.Request) ([]uaRule, error) {
+	matches, urls := r.PostForm["ua-match"], r.PostForm["ua-url"]
+	if len(matches) != len(urls) {
+		return nil, errors.New("give a ua-url for every ua-match")
+	}
+	if len(matches) > maxUARules {
+		return nil, fmt.Errorf("too many rules - a slug can have at most %d", maxUARules)
+	}
+
+	var rules []uaRule
+	for ix, match := range matches {
+		if strings.Trim(match, " |") == "" {
+			return nil, fmt.Errorf("ua-match %d is empty", ix+1)
+		}
+		url := normalizeTarget(strings.TrimSpace(urls[ix]))
+		if e := validateTarget(url); e != nil {
+			return nil, fmt.Errorf("ua-url %d: %v", ix+1, e)
+		}
+		rules = append(rules, uaRule{Match: match, URL: url})
+	}
+	return rules, nil
+}
+
+// encodeUARules gives the rules as stored, match:url pairs separated by spaces, with the match escaped
+// so that it can't contain either
+func encodeUARules(rules []uaRule) string {
+	pairs := make([]string, len(rules))
+	for ix, rule := range rules {
+		pairs[ix] = url.QueryEscape(rule.Match) + ":" + rule.URL
+	}
+	return strings.Join(pairs, " ")
+}
+
+func decodeUARules(value string) []uaRule {
+	var rules []uaRule
+	for _, pair := range strings.Fields(value) {
+		escaped, target, ok := strings.Cut(pair, ":")
+		match, e := url.QueryUnescape(escaped)
+		if ok && e == nil && match != "" && target != "" {
+			rules = append(rules, uaRule{Match: match, URL: target})
+		}
+	}
+	return rules
+}
+
+// chooseTarget gives where a redirect for the slug goes for this request - the first rule matching the
+// User-Agent, and otherwise the target or one of the targets it rotates between. It needs to be called
+// with at least the read lock on storage held
+func chooseTarget(slug, target string, r *http.Request) string {
+	for _, rule := range uaRules[slug] {
+		if rule.matches(r.UserAgent()) {
+			return rule.URL
+		}
+	}
+	return pickTarget(slug, target)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	slugStrategyRandom     = "random"
+	slugStrategySequential = "sequential"
+)
+
+// The number the next sequential slug is made from. Protected by storageMutex. It's persisted along with
+// the slugs, so that no number is handed out twice, even when the slug it was used for has been deleted
+var nextSequence uint64
+
+// The storage file line that holds nextSequence. Slugs can't contain #, so it can't be mistaken for a slug
+const sequencePrefix = "#sequence "
+
+// encodeSequence writes the number in the slug alphabet, padded to -min-slug-length. Numbers short enough
+// to need padding all have the same length, so no two numbers give the same slug
+func encodeSequence(n uint64) string {
+	alphabet := []rune(slugPossibilities())
+	base := uint64(len(alphabet))
+	var digits []rune
+	for {
+		digits = append(digits, alphabet[n%base])
+		n /= base
+		if n == 0 {
+			break
+		}
+	}
+	for len(digits) < *MinSlugLengthConfig {
+		digits = append(digits, alphabet[0])
+	}
+	slices.Reverse(digits)
+	return string(digits)
+}
+
+// genSequentialSlug needs to be called with the write lock on storage held. Numbers whose slugs are taken,
+// reserved or blocked are skipped. A dry run gives the slug the next submission would get, without using
+// up its number
+func genSequentialSlug(dryRun bool) (string, error) {
+	for n := nextSequence; ; n++ {
+		s := encodeSequence(n)
+		if *SlugChecksumConfig {
+			s = withChecksum(s)
+		}
+		if len(s) > *MaxSlugLengthConfig {
+			return "", fmt.Errorf("sequential slugs have grown past -max-slug-length %d", *MaxSlugLengthConfig)
+		}
+		if _, ok := storage.Get(s); !ok && !reservedSlugs[s] && !blockedSlug(s) && !caseVariantTaken(s) {
+			if !dryRun {
+				nextSequence = n + 1
+				slugsGeneratedTotal.Add(1)
+			}
+			return s, nil
+		}
+		if !dryRun {
+			slugCollisionsTotal.Add(1)
+		}
+	}
+}
+
+func sequenceLine() string {
+	return fmt.Sprintf("%s%d", sequencePrefix, nextSequence)
+}
+
+// parseSequenceLine reads the counter from a storage file line, returning false for lines holding slugs.
+// Append mode leaves one of these behind for every write, and the highest one is the one to use
+func parseSequenceLine(line string) (uint64, bool) {
+	value, ok := strings.CutPrefix(line, sequencePrefix)
+	if !ok {
+		return 0, false
+	}
+	n, _ := strconv.ParseUint(value, 10, 64)
+	return n, true
+}
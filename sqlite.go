@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The sqlite driver isn't part of the standard library, so it is only linked in when building
+// with -tags sqlite, see sqlite_driver.go
+const sqliteDriver = "sqlite3"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS links (
+	slug    TEXT PRIMARY KEY,
+	url     TEXT NOT NULL,
+	clicks  INTEGER NOT NULL DEFAULT 0,
+	creator TEXT NOT NULL DEFAULT '',
+	expires INTEGER,
+	password TEXT NOT NULL DEFAULT '',
+	uses     INTEGER NOT NULL DEFAULT 0,
+	created  INTEGER,
+	ip       TEXT NOT NULL DEFAULT '',
+	wildcard INTEGER NOT NULL DEFAULT 0,
+	alias    INTEGER NOT NULL DEFAULT 0,
+	targets  TEXT NOT NULL DEFAULT '',
+	rules    TEXT NOT NULL DEFAULT '',
+	accessed INTEGER,
+	note     TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS settings (
+	name  TEXT PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+`
+
+// Changes made after the first version of the schema, which older databases are missing. Lookups by URL are
+// served from memory, so the index on url was never used
+var sqliteMigrations = []string{
+	`ALTER TABLE links ADD COLUMN password TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE links ADD COLUMN uses INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE links ADD COLUMN created INTEGER`,
+	`ALTER TABLE links ADD COLUMN ip TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE links ADD COLUMN wildcard INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE links ADD COLUMN alias INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE links ADD COLUMN targets TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE links ADD COLUMN rules TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE links ADD COLUMN accessed INTEGER`,
+	`ALTER TABLE links ADD COLUMN note TEXT NOT NULL DEFAULT ''`,
+	`DROP INDEX IF EXISTS links_url`,
+}
+
+const sqliteUpsert = `INSERT OR REPLACE INTO links (slug, url, clicks, creator, expires, password, uses, created, ip, wildcard, alias, targets, rules, accessed, note) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+func openSQLite(dsn string) (*sqliteBackend, error) {
+	db, e := sql.Open(sqliteDriver, dsn)
+	if e != nil {
+		return nil, fmt.Errorf("opening sqlite database: %v - goshort has to be built with -tags sqlite to use this backend", e)
+	}
+	if _, e := db.Exec(sqliteSchema); e != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating sqlite schema: %v", e)
+	}
+	for _, migration := range sqliteMigrations {
+		if _, e := db.Exec(migration); e != nil && !strings.Contains(e.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("migrating sqlite schema: %v", e)
+		}
+	}
+	return &sqliteBackend{db: db}, nil
+}
+
+func (s *sqliteBackend) load() error {
+	var sequence uint64
+	e := s.db.QueryRow(`SELECT value FROM settings WHERE name = 'sequence'`).Scan(&sequence)
+	if e != nil && e != sql.ErrNoRows {
+		return e
+	}
+	nextSequence = max(nextSequence, sequence)
+
+	rows, e := s.db.Query(`SELECT slug, url, clicks, creator, expires, password, uses, created, ip, wildcard, alias, targets, rules, accessed, note FROM links`)
+	if e != nil {
+		return e
+	}
+	defer rows.Close()
+
+	folder := make(slugFolder)
+	var foldedFrom []string
+	for rows.Next() {
+		var slug, url string
+		var count uint64
+		var meta linkMeta
+		var expires, created, accessed sql.NullInt64
+		var targets, rules string
+		if e := rows.Scan(&slug, &url, &count, &meta.creator, &expires, &meta.password, &meta.uses, &created, &meta.ip, &meta.wildcard, &meta.alias, &targets, &rules, &accessed, &meta.note); e != nil {
+			return e
+		}
+		meta.targets = decodeRotation(targets)
+		meta.rules = decodeUARules(rules)
+		if expires.Valid {
+			meta.expiry = time.Unix(expires.Int64, 0)
+		}
+		if created.Valid {
+			meta.created = time.Unix(created.Int64, 0)
+		}
+		if accessed.Valid {
+			meta.accessed = time.Unix(accessed.Int64, 0)
+		}
+		folded := folder.fold(slug)
+		if folded != slug {
+			foldedFrom = append(foldedFrom, slug)
+		}
+		loadEntry(folded, url, count, meta)
+	}
+	if e := rows.Err(); e != nil {
+		return e
+	}
+	rows.Close()
+	return s.moveFolded(foldedFrom)
+}
+
+// moveFolded gives the rows for slugs that were lower cased when loading their lower case slugs, so that
+// deleting one of those slugs also deletes its row. The new rows are written before the old ones are
+// deleted, leaving both rather than neither if anything fails
+func (s *sqliteBackend) moveFolded(slugs []string) error {
+	if len(slugs) == 0 {
+		return nil
+	}
+	folded := make([]string, len(slugs))
+	for ix, slug := range slugs {
+		folded[ix] = strings.ToLower(slug)
+	}
+	if e := s.upsert(folded); e != nil {
+		return e
+	}
+	for _, slug := range slugs {
+		if e := s.remove(slug); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// upsertArgs needs to be called with at least the read lock on storage held
+func upsertArgs(slug string) []interface{} {
+	var expires, created, accessed sql.NullInt64
+	clicksMutex.Lock()
+	count := clicks[slug]
+	if accessedTime, ok := lastAccess[slug]; ok {
+		accessed = sql.NullInt64{Int64: accessedTime.Unix(), Valid: true}
+	}
+	clicksMutex.Unlock()
+	if expiry, ok := expiries[slug]; ok {
+		expires = sql.NullInt64{Int64: expiry.Unix(), Valid: true}
+	}
+	if createdTime, ok := createdAt[slug]; ok {
+		created = sql.NullInt64{Int64: createdTime.Unix(), Valid: true}
+	}
+	url, _ := storage.Get(slug)
+	return []interface{}{slug, url, count, creators[slug], expires, passwords[slug], remainingUses[slug], created, createdFrom[slug], wildcards[slug], aliases[slug], encodeRotation(rotations[slug]), encodeUARules(uaRules[slug]), accessed, notes[slug]}
+}
+
+// migrated reports whether the storage file has been migrated into the database, or found to have
+// nothing to migrate. Checking the database for being empty isn't enough, since it is empty again
+// once every slug has been deleted
+func (s *sqliteBackend) migrated() (bool, error) {
+	var value int
+	e := s.db.QueryRow(`SELECT value FROM settings WHERE name = 'migrated'`).Scan(&value)
+	if e == sql.ErrNoRows {
+		return false, nil
+	}
+	return value == 1, e
+}
+
+func (s *sqliteBackend) markMigrated() error {
+	_, e := s.db.Exec(`INSERT OR REPLACE INTO settings (name, value) VALUES ('migrated', 1)`)
+	return e
+}
+
+func (s *sqliteBackend) save(slugs ...string) error {
+	return s.upsert(slugs)
+}
+
+func (s *sqliteBackend) remove(slug string) error {
+	_, e := s.db.Exec(`DELETE FROM links WHERE slug = ?`, slug)
+	return e
+}
+
+func (s *sqliteBackend) flush() error {
+	slugs := make([]string, 0, storage.Len())
+	storage.Each(func(slug, url string) {
+		if !seeded[slug] {
+			slugs = append(slugs, slug)
+		}
+	})
+	return s.upsert(slugs)
+}
+
+// upsert writes the slugs in one transaction
+func (s *sqliteBackend) upsert(slugs []string) error {
+	tx, e := s.db.Begin()
+	if e != nil {
+		return e
+	}
+	stmt, e := tx.Prepare(sqliteUpsert)
+	if e != nil {
+		tx.Rollback()
+		return e
+	}
+	defer stmt.Close()
+
+	for _, slug := range slugs {
+		if _, e := stmt.Exec(upsertArgs(slug)...); e != nil {
+			tx.Rollback()
+			return e
+		}
+	}
+	if nextSequence > 0 {
+		if _, e := tx.Exec(`INSERT OR REPLACE INTO settings (name, value) VALUES ('sequence', ?)`, nextSequence); e != nil {
+			tx.Rollback()
+			return e
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteBackend) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Storage keeps track of which URL each slug points to, and the other way around. Implementations
+// don't do any locking of their own - lookups have to be done with at least the read lock on
+// storageMutex held, and changes with the write lock held
+type Storage interface {
+	// Get returns the URL the slug points to
+	Get(slug string) (string, bool)
+	// GetSlugForURL returns the slug that was created for the URL
+	GetSlugForURL(url string) (string, bool)
+	// Put points the slug at the URL, replacing anything the slug pointed to before
+	Put(slug, url string)
+	// Alias points the slug at the URL like Put, but only makes it the slug for the URL when the URL
+	// doesn't have one already
+	Alias(slug, url string)
+	Delete(slug string)
+	// HasCaseVariant reports whether another slug differing from this one only in case exists
+	HasCaseVariant(slug string) bool
+	Len() int
+	// Each calls the function for every slug, in no particular order
+	Each(func(slug, url string))
+}
+
+// mapStorage is the default Storage, keeping everything in memory. The reverse map only ever points
+// at a slug that points back at the same URL - Put and Delete keep it that way, so nothing else may
+// touch the maps. Folded counts the slugs sharing each lower case form
+type mapStorage struct {
+	slugs   map[string]string
+	reverse map[string]string
+	folded  map[string]int
+}
+
+func newMapStorage() *mapStorage {
+	return &mapStorage{
+		slugs:   make(map[string]string),
+		reverse: make(map[string]string),
+		folded:  make(map[string]int),
+	}
+}
+
+func (m *mapStorage) Get(slug string) (string, bool) {
+	url, ok := m.slugs[slug]
+	return url, ok
+}
+
+func (m *mapStorage) GetSlugForURL(url string) (string, bool) {
+	slug, ok := m.reverse[url]
+	return slug, ok
+}
+
+func (m *mapStorage) Put(slug, url string) {
+	if old, ok := m.slugs[slug]; !ok {
+		m.folded[strings.ToLower(slug)]++
+	} else if m.reverse[old] == slug {
+		delete(m.reverse, old)
+	}
+	m.slugs[slug] = url
+	m.reverse[url] = slug
+}
+
+func (m *mapStorage) Alias(slug, url string) {
+	if old, ok := m.slugs[slug]; !ok {
+		m.folded[strings.ToLower(slug)]++
+	} else if m.reverse[old] == slug {
+		delete(m.reverse, old)
+	}
+	m.slugs[slug] = url
+	if _, ok := m.reverse[url]; !ok {
+		m.reverse[url] = slug
+	}
+}
+
+func (m *mapStorage) Delete(slug string) {
+	url, ok := m.slugs[slug]
+	if !ok {
+		return
+	}
+	delete(m.slugs, slug)
+	if m.reverse[url] == slug {
+		delete(m.reverse, url)
+	}
+	if folded := strings.ToLower(slug); m.folded[folded] > 1 {
+		m.folded[folded]--
+	} else {
+		delete(m.folded, folded)
+	}
+}
+
+func (m *mapStorage) HasCaseVariant(slug string) bool {
+	variants := m.folded[strings.ToLower(slug)]
+	if _, ok := m.slugs[slug]; ok {
+		variants--
+	}
+	return variants > 0
+}
+
+// rebuildReverse recreates the reverse map from the slugs, keeping existing entries that are still
+// right. It returns how many entries were wrong or missing
+func (m *mapStorage) rebuildReverse() int {
+	reverse := make(map[string]string, len(m.reverse))
+	for slug, url := range m.slugs {
+		if current, ok := m.reverse[url]; ok && m.slugs[current] == url {
+			reverse[url] = current
+		} else if existing, ok := reverse[url]; !ok || slug < existing {
+			reverse[url] = slug
+		}
+	}
+
+	fixed := 0
+	for url, slug := range m.reverse {
+		if reverse[url] != slug {
+			fixed++
+		}
+	}
+	for url := range reverse {
+		if _, ok := m.reverse[url]; !ok {
+			fixed++
+		}
+	}
+	m.reverse = reverse
+	return fixed
+}
+
+func (m *mapStorage) Len() int {
+	return len(m.slugs)
+}
+
+func (m *mapStorage) Each(f func(slug, url string)) {
+	for slug, url := range m.slugs {
+		f(slug, url)
+	}
+}
+
+const (
+	storageBackendFile   = "file"
+	storageBackendSQLite = "sqlite"
+)
+
+// A backend persists the shortened URLs. Lookups by slug and by URL are always served from
+// Storage, which is loaded from the backend at startup - the backend only has to make
+// creations and deletions durable. All methods except load are called with the write
+// lock on storage held
+type backend interface {
+	// load reads all slugs from the backend into storage
+	load() error
+	// save persists newly created slugs, with a single write for all of them
+	save(slugs ...string) error
+	// remove persists the deletion of a slug that has already been removed from storage
+	remove(slug string) error
+	// flush writes everything in storage, including click counts, to the backend
+	flush() error
+	close() error
+}
+
+var activeBackend backend = fileBackend{}
+
+// fileBackend is the original flat file storage
+type fileBackend struct{}
+
+func (fileBackend) load() error {
+	readStorage()
+	return nil
+}
+
+func (fileBackend) save(slugs ...string) error {
+	return saveStorage(slugs...)
+}
+
+func (fileBackend) remove(slug string) error {
+	// Always rewrite here, since an append-only log can't express removals
+	markDirty()
+	return nil
+}
+
+func (fileBackend) flush() error {
+	return writeStorage()
+}
+
+func (fileBackend) close() error {
+	return nil
+}
+
+// newBackend opens the backend given by -storage-backend, without loading anything from it
+func newBackend() (backend, error) {
+	if *StorageBackendConfig == storageBackendSQLite {
+		return openSQLite(*StorageDSNConfig)
+	}
+	return fileBackend{}, nil
+}
+
+// loadBackend loads all slugs from the active backend. When the sqlite backend starts out
+// empty, URLs from the storage file are migrated into it. That only happens the first
+// time, so that slugs deleted since don't come back
+func loadBackend() error {
+	readSeed()
+	sqlite, ok := activeBackend.(*sqliteBackend)
+	if !ok {
+		return activeBackend.load()
+	}
+
+	seeds := storage.Len()
+	if e := sqlite.load(); e != nil {
+		return e
+	}
+
+	migrated, e := sqlite.migrated()
+	if e != nil {
+		return e
+	}
+	if migrated {
+		return nil
+	}
+	// Databases from before the migration was recorded have it done already if they hold any slugs
+	if storage.Len() == seeds && fileExists(*FilenameStorageConfig) {
+		readStorage()
+		if e := sqlite.flush(); e != nil {
+			return fmt.Errorf("migrating %s: %v", *FilenameStorageConfig, e)
+		}
+		slog.Info("migrated URLs to sqlite", "urls", storage.Len(), "file", *FilenameStorageConfig)
+	}
+	return sqlite.markMigrated()
+}
+
+// pruneOrphans removes entries for slugs that aren't in storage, returning how many there were
+func pruneOrphans[V any](entries map[string]V) int {
+	orphans := 0
+	for slug := range entries {
+		if _, ok := storage.Get(slug); !ok {
+			delete(entries, slug)
+			orphans++
+		}
+	}
+	return orphans
+}
+
+// checkConsistency makes sure that the reverse lookup and everything kept about slugs agrees with the
+// slugs themselves, logging whatever had to be fixed. It needs to be called with the write lock on
+// storage held
+func checkConsistency() {
+	if m, ok := storage.(*mapStorage); ok {
+		if fixed := m.rebuildReverse(); fixed > 0 {
+			slog.Warn("fixed inconsistent reverse lookup entries", "entries", fixed)
+		}
+	}
+
+	orphans := pruneOrphans(creators) + pruneOrphans(expiries) + pruneOrphans(createdAt) +
+		pruneOrphans(createdFrom) + pruneOrphans(passwords) + pruneOrphans(remainingUses) +
+		pruneOrphans(wildcards) + pruneOrphans(aliases) + pruneOrphans(rotations) +
+		pruneOrphans(uaRules) + pruneOrphans(notes) + pruneOrphans(seeded)
+	clicksMutex.Lock()
+	orphans += pruneOrphans(clicks) + pruneOrphans(lastAccess)
+	clicksMutex.Unlock()
+	recountKeyUsage()
+	if orphans > 0 {
+		slog.Warn("removed data kept for slugs that don't exist", "entries", orphans)
+	}
+}
+
+// persistSlugs saves new or changed slugs. A seeded slug that is saved belongs to the storage from then on.
+// Failures are logged, and returned for callers that can tell the client the change isn't durable
+func persistSlugs(slugs ...string) error {
+	for _, slug := range slugs {
+		delete(seeded, slug)
+	}
+	e := activeBackend.save(slugs...)
+	if e != nil {
+		slog.Error("saving to storage", "slugs", strings.Join(slugs, ","), "error", e)
+	}
+	return e
+}
+
+func persistRemoval(slug string) {
+	if e := activeBackend.remove(slug); e != nil {
+		slog.Error("removing from storage", "slug", slug, "error", e)
+	}
+}
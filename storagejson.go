@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+const (
+	storageFormatText = "text"
+	storageFormatJSON = "json"
+)
+
+// storedLink is one slug in a JSON storage file, which holds an array of them. The counter for sequential
+// slugs is kept in a record of its own, with only Sequence set
+type storedLink struct {
+	Sequence uint64    `json:"sequence,omitempty"`
+	Slug     string    `json:"slug"`
+	URL      string    `json:"url"`
+	Created  time.Time `json:"created,omitzero"`
+	Clicks   uint64    `json:"clicks,omitempty"`
+	Accessed time.Time `json:"accessed,omitzero"`
+	Expires  time.Time `json:"expires,omitzero"`
+	Key      string    `json:"key,omitempty"`
+	Password string    `json:"password,omitempty"`
+	Uses     uint64    `json:"uses,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Wildcard bool      `json:"wildcard,omitempty"`
+	Alias    bool      `json:"alias,omitempty"`
+	// The targets of a rotating slug, the first of which is also URL
+	Targets []weightedTarget `json:"targets,omitempty"`
+	Rules   []uaRule         `json:"rules,omitempty"`
+	Note    string           `json:"note,omitempty"`
+}
+
+// storedRecord needs to be called with at least the read lock on storage held
+func storedRecord(slug string) storedLink {
+	url, _ := storage.Get(slug)
+	clicksMutex.Lock()
+	count, accessed := clicks[slug], lastAccess[slug]
+	clicksMutex.Unlock()
+	return storedLink{
+		Slug:     slug,
+		URL:      url,
+		Created:  createdAt[slug],
+		Clicks:   count,
+		Accessed: accessed,
+		Expires:  expiries[slug],
+		Key:      creators[slug],
+		Password: passwords[slug],
+		Uses:     remainingUses[slug],
+		IP:       createdFrom[slug],
+		Wildcard: wildcards[slug],
+		Alias:    aliases[slug],
+		Targets:  rotations[slug],
+		Rules:    uaRules[slug],
+		Note:     notes[slug],
+	}
+}
+
+// jsonStorage reports whether the storage file is in the JSON format, by looking for the opening bracket
+// of the array. Text storage files always start with a slug, which can't contain a bracket
+func jsonStorage(r *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		peeked, e := r.Peek(n)
+		if e != nil {
+			return false
+		}
+		switch peeked[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return true
+		}
+		return false
+	}
+}
+
+// writeJSONStorage writes one record per line, so that the file is still pleasant to diff and grep
+func writeJSONStorage(w io.Writer, slugs func(func(slug string))) error {
+	if _, e := io.WriteString(w, "["); e != nil {
+		return e
+	}
+	first := true
+	var failed error
+	if nextSequence > 0 {
+		if _, e := fmt.Fprintf(w, "\n{\"sequence\":%d}", nextSequence); e != nil {
+			return e
+		}
+		first = false
+	}
+	slugs(func(slug string) {
+		if failed != nil {
+			return
+		}
+		data, e := json.Marshal(storedRecord(slug))
+		if e != nil {
+			failed = e
+			return
+		}
+		separator := ","
+		if first {
+			separator = ""
+			first = false
+		}
+		_, failed = fmt.Fprintf(w, "%s\n%s", separator, data)
+	})
+	if failed != nil {
+		return failed
+	}
+	_, e := io.WriteString(w, "\n]\n")
+	return e
+}
+
+// readJSONStorage decodes the records one at a time, adding each record with a slug and a URL to the contents
+func readJSONStorage(r io.Reader, name string, contents *storageContents) error {
+	decoder := json.NewDecoder(r)
+	if _, e := decoder.Token(); e != nil {
+		return e
+	}
+	for decoder.More() {
+		var link storedLink
+		if e := decoder.Decode(&link); e != nil {
+			return e
+		}
+		if link.Sequence > 0 {
+			contents.sequence = max(contents.sequence, link.Sequence)
+			continue
+		}
+		if link.Slug == "" || link.URL == "" {
+			slog.Warn("skipping storage record without slug or URL", "file", name, "slug", link.Slug)
+			continue
+		}
+		contents.add(link.Slug, link.URL, link.Clicks, linkMeta{
+			creator:  link.Key,
+			expiry:   link.Expires,
+			password: link.Password,
+			uses:     link.Uses,
+			created:  link.Created,
+			accessed: link.Accessed,
+			ip:       link.IP,
+			wildcard: link.Wildcard,
+			alias:    link.Alias,
+			targets:  link.Targets,
+			rules:    link.Rules,
+			note:     link.Note,
+		})
+	}
+	_, e := decoder.Token()
+	return e
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleSubmit shortens the posted url, optionally with a requested slug and everything that can be kept
+// about a link
+func handleSubmit(w http.ResponseWriter, r *http.Request, start time.Time) {
+	creator, authorized := authenticate(requestSecret(r, r.PostFormValue("secret")))
+	// Only authorized requests are told what's wrong with them, everything else is just unauthorized
+	if !authorized {
+		countSubmitError(submitErrorUnauthorized)
+		notAuthorized(w)
+		return
+	}
+	url := normalizeTarget(strings.TrimSpace(r.PostFormValue("url")))
+	slug := r.PostFormValue("slug")
+	if url == "" {
+		countSubmitError(submitErrorInvalidURL)
+		http.Error(w, "Missing url - give the URL to shorten in the url field", http.StatusBadRequest)
+		return
+	}
+	if !allowSubmitFrom(r, creator) {
+		countSubmitError(submitErrorRateLimited)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+	if e := validateTarget(url); e != nil {
+		countSubmitError(submitErrorInvalidURL)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if value := r.PostFormValue("ttl"); value != "" {
+		var e error
+		if ttl, e = parseTTL(value); e != nil || ttl <= 0 {
+			countSubmitError(submitErrorInvalidTTL)
+			http.Error(w, fmt.Sprintf("invalid ttl: %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	meta := linkMeta{creator: creator, created: start, ip: clientIP(r), wildcard: r.PostFormValue("wildcard") == "1"}
+	var e error
+	if meta.targets, e = parseRotation(r); e != nil {
+		countSubmitError(submitErrorInvalidURL)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	} else if meta.wildcard && len(meta.targets) > 0 {
+		countSubmitError(submitErrorInvalidURL)
+		http.Error(w, "A wildcard slug can't rotate between several urls", http.StatusBadRequest)
+		return
+	}
+	if meta.rules, e = parseUARules(r); e != nil {
+		countSubmitError(submitErrorInvalidURL)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.note = strings.TrimSpace(r.PostFormValue("note")); len(meta.note) > maxNoteLength {
+		countSubmitError(submitErrorInvalidNote)
+		http.Error(w, fmt.Sprintf("Note is longer than %d bytes", maxNoteLength), http.StatusBadRequest)
+		return
+	}
+	if ttl > 0 {
+		meta.expiry = time.Now().Add(ttl)
+	}
+	if value := r.PostFormValue("max-uses"); value != "" {
+		var e error
+		if meta.uses, e = strconv.ParseUint(value, 10, 64); e != nil || meta.uses == 0 {
+			countSubmitError(submitErrorInvalidMaxUses)
+			http.Error(w, fmt.Sprintf("invalid max-uses: %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	// Hashing is deliberately slow, so it's done before taking the lock
+	if value := r.PostFormValue("password"); value != "" {
+		var e error
+		if meta.password, e = hashPassword(value); e == errPasswordTooLong {
+			countSubmitError(submitErrorInvalidPassword)
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		} else if e != nil {
+			slog.Error("hashing password", "error", e)
+			http.Error(w, "Could not protect link", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if e := validateLine(slug, url, meta); e != nil {
+		countSubmitError(submitErrorInvalidURL)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(r.Header.Get("Idempotency-Key")) > maxIdempotencyKeyLength {
+		countSubmitError(submitErrorInvalidKey)
+		http.Error(w, fmt.Sprintf("Idempotency-Key is longer than %d characters", maxIdempotencyKeyLength), http.StatusBadRequest)
+		return
+	}
+	key := idempotencyKey(r, creator)
+
+	storageMutex.Lock()
+	if previous, ok := previousSubmit(key, start); ok {
+		storageMutex.Unlock()
+		if previous.url != url {
+			http.Error(w, "Idempotency-Key was already used for a different URL", http.StatusUnprocessableEntity)
+			return
+		}
+		writeShortened(w, r, submitResult{Slug: previous.slug, Target: url})
+		return
+	}
+
+	// A dry run goes through the same checks, but leaves storage alone
+	dryRun := r.PostFormValue("dryrun") == "1"
+	var created bool
+	if dryRun {
+		var existing bool
+		slug, existing, e = resolveSlug(url, slug, meta, true)
+		created = !existing
+	} else {
+		slug, created, e = shorten(url, slug, meta)
+	}
+	if e != nil {
+		storageMutex.Unlock()
+		failSubmit(w, e, r.PostFormValue("slug"))
+		return
+	}
+	if dryRun {
+		storageMutex.Unlock()
+		writeShortened(w, r, submitResult{Slug: slug, Target: url, DryRun: true, Exists: !created})
+		return
+	}
+	// A link that would be lost on restart is taken back, so that the client can try again later
+	if created {
+		if e := persistSlugs(slug); e != nil {
+			removeSlug(slug)
+			storageMutex.Unlock()
+			failSubmit(w, errNotStored, slug)
+			return
+		}
+	}
+	rememberSubmit(key, url, slug, start)
+	storageMutex.Unlock()
+	if created {
+		if e := awaitStored(slug); e != nil {
+			forgetSubmit(key, slug)
+			failSubmit(w, e, slug)
+			return
+		}
+		slugsCreatedTotal.Add(1)
+	}
+	writeShortened(w, r, submitResult{Slug: slug, Target: url})
+	if created {
+		slog.Info("added new shortening", "slug", slug, targetAttr("target", url), "client", clientIP(r), "latency", time.Since(start))
+	}
+}
+
+// submitStatus gives the status to answer a failed submission with, and the kind of submit error to count
+// it as. Submissions, bulk submissions and aliases all go through here, so that they answer alike. Running
+// out of room or of slugs is logged, since someone has to do something about it
+func submitStatus(e error) (int, string) {
+	switch e {
+	case errReservedSlug:
+		return http.StatusConflict, submitErrorReservedSlug
+	case errSlugLength:
+		return http.StatusBadRequest, submitErrorInvalidSlug
+	case errSlugTaken, errInvalidSlug, errCaseVariant:
+		return http.StatusConflict, submitErrorSlugTaken
+	case errQuotaExceeded:
+		return http.StatusTooManyRequests, submitErrorQuotaExceeded
+	case errStorageFull:
+		slog.Warn("refusing new shortening, -max-slugs reached", "max", *MaxSlugsConfig)
+		return http.StatusInsufficientStorage, submitErrorStorageFull
+	case errNotStored:
+		return http.StatusInternalServerError, submitErrorNotStored
+	}
+	slog.Error("generating slug", "error", e)
+	return http.StatusServiceUnavailable, submitErrorSlugsExhausted
+}
+
+// submitMessage explains to the client why the slug they asked for, if any, couldn't be created
+func submitMessage(e error, slug string) string {
+	switch e {
+	case errReservedSlug:
+		return fmt.Sprintf("Slug is reserved: %s", slug)
+	case errSlugLength:
+		return slugLengthMessage()
+	case errSlugTaken:
+		return fmt.Sprintf("Slug is already in use: %s", slug)
+	case errInvalidSlug:
+		return fmt.Sprintf("Slug contains characters that aren't allowed: %s", slug)
+	case errCaseVariant:
+		return fmt.Sprintf("A slug differing only in case from %s is already in use", slug)
+	case errQuotaExceeded:
+		return "The API key has used up its quota of links"
+	case errStorageFull:
+		return "The maximum number of links has been reached"
+	case errNotStored:
+		return "Could not store link"
+	}
+	return "No free slugs available"
+}
+
+// failSubmit answers a failed submission, counting it
+func failSubmit(w http.ResponseWriter, e error, slug string) {
+	status, kind := submitStatus(e)
+	countSubmitError(kind)
+	http.Error(w, submitMessage(e, slug), status)
+}